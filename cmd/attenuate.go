@@ -0,0 +1,89 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/stripe-proxy/proxy"
+)
+
+var credentialToAttenuate string
+var inputToAttenuate uint64
+var grantToAttenuate string
+
+// attenuateCmd represents the attenuate command
+var attenuateCmd = &cobra.Command{
+	Use:   "attenuate",
+	Short: "Derive a narrower credential from an existing one",
+	Long: `Derive a credential which grants at most what the existing credential
+grants, restricted further by a permissions vector, an expiry and/or the
+customers and connected accounts which it may access and the amounts which
+it may spend. No signing key is needed, so any holder of a credential can
+hand a narrower one to a sub-component. The derived credential can never
+exceed its parent and is revoked along with it.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if credentialToAttenuate == "" {
+			return errors.New("The credential to attenuate must be specified with --credential")
+		}
+
+		caveat := &proxy.Caveat{}
+		if cmd.Flags().Changed("grant") || cmd.Flags().Changed("input") {
+			permission, err := permissionFromFlags(cmd, grantToAttenuate, inputToAttenuate)
+			if err != nil {
+				return err
+			}
+			caveat.Permission = permission
+		}
+
+		if len(customers) > 0 {
+			caveat.Customers = customers
+		}
+		if len(accounts) > 0 {
+			caveat.Accounts = accounts
+		}
+		caveat.MaxAmount, caveat.Currencies = spendingLimits()
+
+		var err error
+		caveat.NotBefore, caveat.Expires, err = validityWindow(time.Now())
+		if err != nil {
+			return err
+		}
+
+		attenuated, err := proxy.Attenuate(credentialToAttenuate, caveat)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Credentials:")
+		fmt.Printf("%s\n", attenuated)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(attenuateCmd)
+	attenuateCmd.Flags().StringVar(&credentialToAttenuate, "credential", "", "Credential to derive the new credential from")
+	attenuateCmd.Flags().Uint64Var(&inputToAttenuate, "input", 0, "Integer representation of the permissions vector to restrict to")
+	attenuateCmd.Flags().StringVar(&grantToAttenuate, "grant", "", "Comma separated resource:access grants to restrict to, e.g. customers:read")
+	addValidityFlags(attenuateCmd)
+	addScopeFlags(attenuateCmd)
+	addLimitFlags(attenuateCmd)
+}
@@ -0,0 +1,104 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/stripe-proxy/proxy"
+)
+
+// auditCmd represents the audit command
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Work with the audit log of the proxy",
+	Long:  ``,
+}
+
+// auditVerifyCmd represents the audit verify command
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify <audit log>...",
+	Short: "Check that audit logs have not been modified",
+	Long: `Walk the hash chain of one or more audit logs and report the first entry
+which has been changed, removed or reordered. Rotated logs are given oldest
+first, e.g. audit.jsonl.2 audit.jsonl.1 audit.jsonl, so that the chain is
+followed across them. With --audit-keyring the signatures are checked too, and
+the logs must be signed at least every --audit-sign-every entries.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("At least one audit log must be specified")
+		}
+
+		verifier := &proxy.AuditVerifier{}
+		if auditKeyringPath != "" {
+			if auditSignEvery == 0 {
+				return errors.New("--audit-sign-every must be at least 1")
+			}
+			keys, err := proxy.LoadKeyring(auditKeyringPath)
+			if err != nil {
+				return err
+			}
+			verifier.Keys = keys
+		}
+
+		for _, path := range args {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			err = verifier.Verify(path, f)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("Audit log is broken: %s", err)
+			}
+		}
+
+		if verifier.Entries == 0 {
+			fmt.Println("No entries to verify")
+			return nil
+		}
+		last := verifier.FirstSequence + uint64(verifier.Entries) - 1
+		fmt.Printf("Verified the hash chain of entries %d to %d\n", verifier.FirstSequence, last)
+		if verifier.FirstSequence > 0 {
+			fmt.Printf("The entries before %d are not in the given logs\n", verifier.FirstSequence)
+		}
+
+		if verifier.Keys == nil {
+			fmt.Println("Signatures were not checked, no --audit-keyring was given")
+			return nil
+		}
+		if verifier.LastSigned != nil {
+			fmt.Printf("Verified %d signatures, the last of entry %d\n", verifier.Signatures, *verifier.LastSigned)
+			if *verifier.LastSigned < last {
+				fmt.Printf("The %d entries after it are not signed yet and could have been rewritten\n", last-*verifier.LastSigned)
+			}
+		}
+		if err := verifier.CheckSigned(auditSignEvery); err != nil {
+			return fmt.Errorf("Audit log is not signed: %s", err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(auditCmd)
+	auditCmd.AddCommand(auditVerifyCmd)
+	auditVerifyCmd.Flags().StringVar(&auditKeyringPath, "audit-keyring", "", "Path to the keyring which signed the audit log, its public keys suffice")
+	auditVerifyCmd.Flags().Uint64Var(&auditSignEvery, "audit-sign-every", 100, "Interval at which the proxy signed the audit log")
+}
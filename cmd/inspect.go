@@ -0,0 +1,308 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/stripe-proxy/proxy"
+)
+
+var inspectOutput string
+
+type grantReport struct {
+	Resource string `json:"resource"`
+	Access   string `json:"access"`
+}
+
+type caveatReport struct {
+	Grants     []grantReport `json:"grants,omitempty"`
+	NotBefore  *time.Time    `json:"not_before,omitempty"`
+	Expires    *time.Time    `json:"expires,omitempty"`
+	Customers  []string      `json:"customers,omitempty"`
+	Accounts   []string      `json:"accounts,omitempty"`
+	MaxAmount  int64         `json:"max_amount,omitempty"`
+	Currencies []string      `json:"currencies,omitempty"`
+}
+
+// inspectReport is what inspect prints. Customers, Accounts and Currencies
+// are null for credentials which aren't restricted to any.
+type inspectReport struct {
+	ID           string         `json:"id,omitempty"`
+	Fingerprint  string         `json:"fingerprint"`
+	KeyID        string         `json:"key_id,omitempty"`
+	Algorithm    string         `json:"algorithm"`
+	Mode         string         `json:"mode"`
+	Upstream     string         `json:"upstream,omitempty"`
+	Verified     bool           `json:"verified"`
+	Verification string         `json:"verification"`
+	IssuedAt     *time.Time     `json:"issued_at,omitempty"`
+	NotBefore    *time.Time     `json:"not_before,omitempty"`
+	Expires      *time.Time     `json:"expires,omitempty"`
+	Grants       []grantReport  `json:"grants"`
+	Customers    []string       `json:"customers"`
+	Accounts     []string       `json:"accounts"`
+	MaxAmount    int64          `json:"max_amount,omitempty"`
+	Currencies   []string       `json:"currencies"`
+	Budget       int64          `json:"budget,omitempty"`
+	BudgetWindow string         `json:"budget_window,omitempty"`
+	RateLimit    string         `json:"rate_limit,omitempty"`
+	MaxInFlight  int64          `json:"max_in_flight,omitempty"`
+	Caveats      []caveatReport `json:"caveats,omitempty"`
+}
+
+// inspectCmd represents the inspect command
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <credentials>",
+	Short: "Decode credentials and show what they grant",
+	Long: `Decode credentials and print every granted resource and access pair along
+with the embedded claims. The signature and validity window are checked with
+the keyring which the proxy would use: the keyring of the credentials' upstream
+from --upstreams, --keyring or the environment otherwise, and the --stripekey
+for legacy credentials with --accept-legacy-credentials. Without that keyring
+the credentials are reported as unverified.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Exactly one credential must be specified")
+		}
+		if inspectOutput != "text" && inspectOutput != "json" {
+			return fmt.Errorf("Unknown output format %q, must be text or json", inspectOutput)
+		}
+
+		claims, err := proxy.Decode(args[0])
+		if err != nil {
+			return err
+		}
+
+		report := newInspectReport(claims)
+		report.Fingerprint = proxy.CredentialFingerprint(args[0])
+		if err := verifyInspected(report, args[0], claims); err != nil {
+			return err
+		}
+
+		if inspectOutput == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(report)
+		}
+		printInspectReport(report)
+		return nil
+	},
+}
+
+// verifyInspected checks the credentials with the keyring which the proxy
+// would use and records the outcome in the report.
+func verifyInspected(report *inspectReport, credentials string, claims *proxy.Claims) error {
+	keys, unverified, err := inspectKeyring(claims)
+	if err != nil {
+		return err
+	}
+	if keys == nil {
+		report.Verification = "unverified, " + unverified
+		return nil
+	}
+
+	if _, err := proxy.Verify(credentials, keys); err != nil {
+		report.Verification = err.Error()
+	} else {
+		report.Verified = true
+		report.Verification = "verified"
+	}
+	return nil
+}
+
+// inspectKeyring returns the keyring which the proxy would verify the
+// credentials with, or why there is none.
+func inspectKeyring(claims *proxy.Claims) (*proxy.Keyring, string, error) {
+	if claims.Upstream != "" {
+		if upstreamsPath == "" {
+			return nil, fmt.Sprintf("the credentials target upstream %s but no --upstreams was given", claims.Upstream), nil
+		}
+		config, err := proxy.LoadUpstreamConfig(upstreamsPath)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, entry := range config.Upstreams {
+			if entry.Name == claims.Upstream {
+				keys, err := proxy.LoadKeyring(entry.Keyring)
+				return keys, "", err
+			}
+		}
+		return nil, fmt.Sprintf("upstream %s is not configured in %s", claims.Upstream, upstreamsPath), nil
+	}
+
+	if claims.KeyID == proxy.LegacyKeyID {
+		if !acceptLegacyCredentials {
+			return nil, "legacy credentials are only checked with --accept-legacy-credentials", nil
+		}
+		if stripeKey == "" {
+			return nil, "", errors.New("Checking legacy credentials requires the --stripekey which signed them")
+		}
+		keys := &proxy.Keyring{}
+		if keyringPath != "" || os.Getenv(keyringEnv) != "" {
+			loaded, err := loadKeyring()
+			if err != nil {
+				return nil, "", err
+			}
+			keys = loaded
+		}
+		return keys.WithLegacyKey(stripeKey), "", nil
+	}
+
+	if keyringPath == "" && os.Getenv(keyringEnv) == "" {
+		return nil, "no keyring was given", nil
+	}
+	keys, err := loadKeyring()
+	return keys, "", err
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func grantReports(p *proxy.Permission) []grantReport {
+	grants := []grantReport{}
+	for _, grant := range p.Grants() {
+		grants = append(grants, grantReport{grant.Resource.String(), grant.Access.String()})
+	}
+	return grants
+}
+
+func newInspectReport(claims *proxy.Claims) *inspectReport {
+	report := &inspectReport{
+		ID:          claims.ID,
+		KeyID:       claims.KeyID,
+		Algorithm:   string(claims.Algorithm),
+		Mode:        claims.Mode.String(),
+		Upstream:    claims.Upstream,
+		IssuedAt:    optionalTime(claims.IssuedAt),
+		NotBefore:   optionalTime(claims.NotBefore),
+		Expires:     optionalTime(claims.Expires),
+		Grants:      grantReports(claims.Permission),
+		Customers:   claims.Customers,
+		Accounts:    claims.Accounts,
+		MaxAmount:   claims.MaxAmount,
+		Currencies:  claims.Currencies,
+		Budget:      claims.Budget,
+		MaxInFlight: claims.MaxInFlight,
+	}
+	if claims.Budget != 0 {
+		report.BudgetWindow = claims.BudgetWindow.String()
+	}
+	if claims.RateLimit != (proxy.Rate{}) {
+		report.RateLimit = claims.RateLimit.String()
+	}
+
+	for _, caveat := range claims.Caveats {
+		cr := caveatReport{
+			NotBefore:  optionalTime(caveat.NotBefore),
+			Expires:    optionalTime(caveat.Expires),
+			Customers:  caveat.Customers,
+			Accounts:   caveat.Accounts,
+			MaxAmount:  caveat.MaxAmount,
+			Currencies: caveat.Currencies,
+		}
+		if caveat.Permission != nil {
+			cr.Grants = grantReports(caveat.Permission)
+		}
+		report.Caveats = append(report.Caveats, cr)
+	}
+
+	return report
+}
+
+func formatOptionalTime(t *time.Time, unset string) string {
+	if t == nil {
+		return unset
+	}
+	return t.Format(time.RFC3339)
+}
+
+func formatLimit(limit int64) string {
+	if limit == 0 {
+		return "unlimited"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+func formatScope(scope []string) string {
+	switch {
+	case scope == nil:
+		return "all"
+	case len(scope) == 0:
+		return "none"
+	}
+	return strings.Join(scope, ", ")
+}
+
+func printInspectReport(report *inspectReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", report.ID)
+	fmt.Fprintf(w, "Fingerprint:\t%s\n", report.Fingerprint)
+	fmt.Fprintf(w, "Key ID:\t%s (%s)\n", report.KeyID, report.Algorithm)
+	fmt.Fprintf(w, "Signature:\t%s\n", report.Verification)
+	fmt.Fprintf(w, "Mode:\t%s\n", report.Mode)
+	if report.Upstream != "" {
+		fmt.Fprintf(w, "Upstream:\t%s\n", report.Upstream)
+	} else {
+		fmt.Fprintf(w, "Upstream:\tdefault\n")
+	}
+	fmt.Fprintf(w, "Issued at:\t%s\n", formatOptionalTime(report.IssuedAt, "unknown"))
+	fmt.Fprintf(w, "Not before:\t%s\n", formatOptionalTime(report.NotBefore, "-"))
+	fmt.Fprintf(w, "Expires:\t%s\n", formatOptionalTime(report.Expires, "never"))
+	fmt.Fprintf(w, "Customers:\t%s\n", formatScope(report.Customers))
+	fmt.Fprintf(w, "Accounts:\t%s\n", formatScope(report.Accounts))
+	fmt.Fprintf(w, "Max amount:\t%s\n", formatLimit(report.MaxAmount))
+	fmt.Fprintf(w, "Currencies:\t%s\n", formatScope(report.Currencies))
+	if report.Budget != 0 {
+		fmt.Fprintf(w, "Budget:\t%d per %s\n", report.Budget, report.BudgetWindow)
+	} else {
+		fmt.Fprintf(w, "Budget:\tunlimited\n")
+	}
+	if report.RateLimit != "" {
+		fmt.Fprintf(w, "Rate limit:\t%s\n", report.RateLimit)
+	} else {
+		fmt.Fprintf(w, "Rate limit:\tunlimited\n")
+	}
+	fmt.Fprintf(w, "Max in flight:\t%s\n", formatLimit(report.MaxInFlight))
+	fmt.Fprintf(w, "Caveats:\t%d\n", len(report.Caveats))
+	w.Flush()
+
+	fmt.Println("Grants:")
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, grant := range report.Grants {
+		fmt.Fprintf(w, "  %s\t%s\n", grant.Resource, grant.Access)
+	}
+	w.Flush()
+}
+
+func init() {
+	RootCmd.AddCommand(inspectCmd)
+	inspectCmd.Flags().StringVar(&inspectOutput, "output", "text", "Output format, either text or json")
+	inspectCmd.Flags().StringVar(&upstreamsPath, "upstreams", "", "Path to the JSON configuration of the proxy's named Stripe accounts, to verify credentials which target one")
+	inspectCmd.Flags().BoolVar(&acceptLegacyCredentials, "accept-legacy-credentials", false, "Verify credentials signed with the --stripekey before signing keys were introduced")
+}
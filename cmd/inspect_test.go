@@ -0,0 +1,90 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/stripe-proxy/proxy"
+)
+
+// retarget points signed credentials at another upstream without signing
+// them again.
+func retarget(t *testing.T, credentials, upstream string) string {
+	parts := strings.Split(credentials, "_")
+	claims := &proxy.Claims{}
+	claimsBytes, err := base64.RawStdEncoding.DecodeString(parts[0])
+	assert.Nil(t, err)
+	assert.Nil(t, claims.UnmarshalBinary(claimsBytes))
+	claims.Upstream = upstream
+	claimsBytes, err = claims.MarshalBinary()
+	assert.Nil(t, err)
+	parts[0] = base64.RawStdEncoding.EncodeToString(claimsBytes)
+	return strings.Join(parts, "_")
+}
+
+func TestInspectRetargetedCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "inspect")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	keyrings := map[string]*proxy.Keyring{}
+	for _, name := range []string{"eu", "shared"} {
+		key, err := proxy.NewSigningKey(proxy.AlgorithmHMACSHA256)
+		assert.Nil(err)
+		keyrings[name] = &proxy.Keyring{Keys: []*proxy.SigningKey{key}}
+		assert.Nil(keyrings[name].Save(filepath.Join(dir, name+".json")))
+	}
+	config := `{"upstreams": [
+		{"name": "eu", "stripe_key": "sk_live_eu", "keyring": "eu.json"},
+		{"name": "us", "stripe_key": "sk_live_us", "keyring": "shared.json"},
+		{"name": "us-east", "stripe_key": "sk_live_us_east", "keyring": "shared.json"}
+	]}`
+	upstreamsPath = filepath.Join(dir, "upstreams.json")
+	defer func() { upstreamsPath = "" }()
+	assert.Nil(ioutil.WriteFile(upstreamsPath, []byte(config), 0600))
+
+	inspect := func(credentials string) *inspectReport {
+		claims, err := proxy.Decode(credentials)
+		assert.Nil(err)
+		report := newInspectReport(claims)
+		assert.Nil(verifyInspected(report, credentials, claims))
+		return report
+	}
+
+	eu, err := proxy.Sign(&proxy.Claims{Permission: proxy.NewPermission(1), Upstream: "eu"}, keyrings["eu"])
+	assert.Nil(err)
+	us, err := proxy.Sign(&proxy.Claims{Permission: proxy.NewPermission(1), Upstream: "us"}, keyrings["shared"])
+	assert.Nil(err)
+	assert.True(inspect(eu).Verified)
+	assert.True(inspect(us).Verified)
+
+	// Editing the upstream breaks the signature, even when the other
+	// upstream has the same keyring
+	for _, credentials := range []string{retarget(t, eu, "us"), retarget(t, us, "us-east")} {
+		report := inspect(credentials)
+		assert.False(report.Verified)
+		assert.NotEqual("verified", report.Verification)
+	}
+}
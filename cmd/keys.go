@@ -0,0 +1,197 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/stripe-proxy/proxy"
+)
+
+var keyAlgorithm string
+var rotateAlgorithm string
+var publicKeyringPath string
+
+// keysCmd represents the keys command
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage the keyring used to sign credentials",
+	Long:  ``,
+}
+
+// keysInitCmd represents the keys init command
+var keysInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Create a new keyring file containing a single signing key",
+	Long:  ``,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if keyringPath == "" {
+			return errors.New("The keyring file must be specified with --keyring")
+		}
+		if _, err := os.Stat(keyringPath); err == nil {
+			return fmt.Errorf("Keyring file %s already exists", keyringPath)
+		}
+
+		key, err := proxy.NewSigningKey(proxy.KeyAlgorithm(keyAlgorithm))
+		if err != nil {
+			return err
+		}
+
+		keys := &proxy.Keyring{Keys: []*proxy.SigningKey{key}}
+		if err := keys.Save(keyringPath); err != nil {
+			return err
+		}
+
+		log.Infof("Created keyring %s with signing key %s", keyringPath, key.ID)
+		return nil
+	},
+}
+
+// keysRotateCmd represents the keys rotate command
+var keysRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Add a new signing key and mark the existing keys as verify-only",
+	Long: `Add a new signing key to the keyring file. New credentials are signed with
+the new key, while credentials signed with the previous keys are still accepted
+until those keys are retired. A running proxy picks up the change without a
+restart.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keys, err := loadKeyringFile()
+		if err != nil {
+			return err
+		}
+
+		key, err := keys.Rotate(proxy.KeyAlgorithm(rotateAlgorithm))
+		if err != nil {
+			return err
+		}
+		if err := keys.Save(keyringPath); err != nil {
+			return err
+		}
+
+		log.Infof("Rotated keyring %s to signing key %s", keyringPath, key.ID)
+		return nil
+	},
+}
+
+// keysRetireCmd represents the keys retire command
+var keysRetireCmd = &cobra.Command{
+	Use:   "retire <key id>",
+	Short: "Remove a verify-only key, rejecting the credentials it signed",
+	Long:  ``,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Exactly one key ID must be specified")
+		}
+
+		keys, err := loadKeyringFile()
+		if err != nil {
+			return err
+		}
+
+		if err := keys.Retire(args[0]); err != nil {
+			return err
+		}
+		if err := keys.Save(keyringPath); err != nil {
+			return err
+		}
+
+		log.Infof("Retired key %s from keyring %s", args[0], keyringPath)
+		return nil
+	},
+}
+
+// keysListCmd represents the keys list command
+var keysListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the keys in the keyring",
+	Long:  ``,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keys, err := loadKeyring()
+		if err != nil {
+			return err
+		}
+
+		signingKey, _ := keys.SigningKey()
+		for _, key := range keys.Keys {
+			status := "verify-only"
+			if key == signingKey {
+				status = "signing"
+			} else if !key.VerifyOnly {
+				status = "verify"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", key.ID, key.Algorithm, key.Created.Format(time.RFC3339), status)
+		}
+		return nil
+	},
+}
+
+// keysPublicCmd represents the keys public command
+var keysPublicCmd = &cobra.Command{
+	Use:   "public",
+	Short: "Write a keyring containing only the Ed25519 public keys",
+	Long: `Write a copy of the keyring which contains only the public halves of its
+Ed25519 keys. Run the proxy with this keyring so that a compromised proxy host
+can verify, but never issue, credentials. The private keyring can then be kept
+offline and only used with the sign command.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if publicKeyringPath == "" {
+			return errors.New("The public keyring file must be specified with --output")
+		}
+
+		keys, err := loadKeyring()
+		if err != nil {
+			return err
+		}
+
+		public, err := keys.Public()
+		if err != nil {
+			return err
+		}
+		if err := public.Save(publicKeyringPath); err != nil {
+			return err
+		}
+
+		log.Infof("Wrote public keyring with %d keys to %s", len(public.Keys), publicKeyringPath)
+		return nil
+	},
+}
+
+// loadKeyringFile loads the keyring from --keyring for modification.
+func loadKeyringFile() (*proxy.Keyring, error) {
+	if keyringPath == "" {
+		return nil, errors.New("The keyring file must be specified with --keyring")
+	}
+	return proxy.LoadKeyring(keyringPath)
+}
+
+func init() {
+	RootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysInitCmd)
+	keysCmd.AddCommand(keysRotateCmd)
+	keysCmd.AddCommand(keysRetireCmd)
+	keysCmd.AddCommand(keysListCmd)
+	keysCmd.AddCommand(keysPublicCmd)
+
+	keysInitCmd.Flags().StringVar(&keyAlgorithm, "algorithm", string(proxy.AlgorithmHMACSHA256), "Signing algorithm for the new key, either hmac-sha256 or ed25519")
+	keysRotateCmd.Flags().StringVar(&rotateAlgorithm, "algorithm", "", "Signing algorithm for the new key, either hmac-sha256 or ed25519 (default that of the current signing key)")
+	keysPublicCmd.Flags().StringVar(&publicKeyringPath, "output", "", "Path to write the public keyring to")
+}
@@ -0,0 +1,119 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/stripe-proxy/proxy"
+)
+
+var revokeReason string
+
+// revokeCmd represents the revoke command
+var revokeCmd = &cobra.Command{
+	Use:   "revoke <credential id>",
+	Short: "Revoke a single credential by its ID",
+	Long: `Add a credential ID to the revocation list. A running proxy rejects the
+credential once it has picked up the change.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Exactly one credential ID must be specified")
+		}
+		id := args[0]
+
+		revocations, err := loadRevocations()
+		if err != nil {
+			return err
+		}
+
+		if err := revocations.Revoke(id, revokeReason); err != nil {
+			return err
+		}
+		if err := revocations.Save(revocationsPath); err != nil {
+			return err
+		}
+
+		log.Infof("Revoked credential %s", id)
+		return nil
+	},
+}
+
+// unrevokeCmd represents the unrevoke command
+var unrevokeCmd = &cobra.Command{
+	Use:   "unrevoke <credential id>",
+	Short: "Remove a credential from the revocation list",
+	Long:  ``,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Exactly one credential ID must be specified")
+		}
+		id := args[0]
+
+		revocations, err := loadRevocations()
+		if err != nil {
+			return err
+		}
+
+		if err := revocations.Unrevoke(id); err != nil {
+			return err
+		}
+		if err := revocations.Save(revocationsPath); err != nil {
+			return err
+		}
+
+		log.Infof("Unrevoked credential %s", id)
+		return nil
+	},
+}
+
+// listRevokedCmd represents the list-revoked command
+var listRevokedCmd = &cobra.Command{
+	Use:   "list-revoked",
+	Short: "List the revoked credential IDs",
+	Long:  ``,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		revocations, err := loadRevocations()
+		if err != nil {
+			return err
+		}
+
+		for _, r := range revocations.Revocations {
+			fmt.Printf("%s\t%s\t%s\n", r.ID, r.Revoked.Format(time.RFC3339), r.Reason)
+		}
+		return nil
+	},
+}
+
+// loadRevocations loads the revocation list from --revocations for
+// modification.
+func loadRevocations() (*proxy.RevocationList, error) {
+	if revocationsPath == "" {
+		return nil, errors.New("The revocation file must be specified with --revocations")
+	}
+	return proxy.LoadRevocationList(revocationsPath)
+}
+
+func init() {
+	RootCmd.AddCommand(revokeCmd)
+	RootCmd.AddCommand(unrevokeCmd)
+	RootCmd.AddCommand(listRevokedCmd)
+	revokeCmd.Flags().StringVar(&revokeReason, "reason", "", "Why the credential was revoked")
+}
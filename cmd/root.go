@@ -15,15 +15,22 @@
 package cmd
 
 import (
+	"errors"
 	"os"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+
+	"github.com/coreos/stripe-proxy/proxy"
 )
 
+const keyringEnv = "STRIPE_PROXY_KEYRING"
+
 var cfgFile string
 var stripeKey string
+var keyringPath string
+var revocationsPath string
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
@@ -46,6 +53,8 @@ func init() {
 
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.stripe-proxy.yaml)")
 	RootCmd.PersistentFlags().StringVar(&stripeKey, "stripekey", "", "Stripe private key")
+	RootCmd.PersistentFlags().StringVar(&revocationsPath, "revocations", "", "Path to the JSON list of revoked credential IDs")
+	RootCmd.PersistentFlags().StringVar(&keyringPath, "keyring", "", "Path to the JSON keyring of credential signing keys (default is $"+keyringEnv+")")
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -63,3 +72,15 @@ func initConfig() {
 		log.Info("Using config file:", viper.ConfigFileUsed())
 	}
 }
+
+// loadKeyring reads the signing keyring from the --keyring file, or from the
+// keyring JSON in the environment if no file was specified.
+func loadKeyring() (*proxy.Keyring, error) {
+	if keyringPath != "" {
+		return proxy.LoadKeyring(keyringPath)
+	}
+	if data := os.Getenv(keyringEnv); data != "" {
+		return proxy.ParseKeyring([]byte(data))
+	}
+	return nil, errors.New("A signing keyring must be specified with --keyring or $" + keyringEnv)
+}
@@ -15,14 +15,25 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
 	"github.com/coreos/stripe-proxy/proxy"
 )
@@ -31,6 +42,21 @@ var upstreamURI string
 var listenAddr string
 var certificatePath string
 var privateKeyPath string
+var acceptLegacyCredentials bool
+var reloadInterval time.Duration
+var budgetLedgerPath string
+var rateLimit string
+var maxInFlight int64
+var testStripeKey string
+var liveStripeKey string
+var upstreamsPath string
+var auditLogPath string
+var auditLogMaxSize int64
+var auditLogMaxBackups int
+var auditKeyringPath string
+var auditSignEvery uint64
+var adminListenAddr string
+var otlpEndpoint string
 
 // serveCmd represents the serve command
 var serveCmd = &cobra.Command{
@@ -53,8 +79,107 @@ var serveCmd = &cobra.Command{
 			return errors.New(msg)
 		}
 
+		keys, err := keyringSource()
+		if err != nil {
+			return err
+		}
+		if acceptLegacyCredentials {
+			keys = proxy.WithLegacyKeySource(keys, stripeKey)
+		}
+
+		var opts []proxy.Option
+		if testStripeKey != "" || liveStripeKey != "" {
+			if testStripeKey != "" && proxy.KeyMode(testStripeKey) != proxy.ModeTest {
+				return errors.New("The --test-stripekey must be a test mode key, e.g. sk_test_")
+			}
+			if liveStripeKey != "" && proxy.KeyMode(liveStripeKey) != proxy.ModeLive {
+				return errors.New("The --live-stripekey must be a live mode key, e.g. sk_live_")
+			}
+			opts = append(opts, proxy.WithModeKeys(testStripeKey, liveStripeKey))
+		}
+		if revocationsPath != "" {
+			revocations, err := proxy.NewRevocationFile(revocationsPath)
+			if err != nil {
+				return err
+			}
+			revocations.Watch(reloadInterval, func(err error) {
+				log.Errorf("Unable to reload revocations %s, continuing with previous list: %s", revocationsPath, err)
+			})
+			opts = append(opts, proxy.WithRevocations(revocations))
+		}
+
+		if budgetLedgerPath != "" {
+			ledger, err := proxy.OpenLedgerFile(budgetLedgerPath)
+			if err != nil {
+				return err
+			}
+			defer ledger.Close()
+			opts = append(opts, proxy.WithBudgetLedger(ledger, func(err error) {
+				log.Errorf("Unable to record spending in the budget ledger %s: %s", budgetLedgerPath, err)
+			}))
+		}
+
+		if rateLimit != "" || maxInFlight != 0 {
+			var rate proxy.Rate
+			if rateLimit != "" {
+				rate, err = proxy.ParseRate(rateLimit)
+				if err != nil {
+					return err
+				}
+			}
+			opts = append(opts, proxy.WithRateLimits(rate, maxInFlight))
+		}
+
+		if upstreamsPath != "" {
+			upstreams, err := loadUpstreams(upstreamsPath)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, proxy.WithUpstreams(upstreams))
+		}
+
+		if auditLogPath != "" {
+			audit, closeAudit, err := openAuditLog()
+			if err != nil {
+				return err
+			}
+			defer closeAudit()
+			opts = append(opts, proxy.WithAuditLog(audit, func(err error) {
+				log.Errorf("Unable to record a request in the audit log %s: %s", auditLogPath, err)
+			}))
+		}
+
+		if adminListenAddr != "" {
+			opts = append(opts, proxy.WithMetrics(proxy.NewMetrics(prometheus.DefaultRegisterer)))
+
+			admin := http.NewServeMux()
+			admin.Handle("/metrics", promhttp.Handler())
+			go func() {
+				log.Infof("Serving metrics on %s", adminListenAddr)
+				log.Fatal(http.ListenAndServe(adminListenAddr, admin))
+			}()
+		}
+
 		rp := httputil.NewSingleHostReverseProxy(url)
-		proxy := proxy.NewStripePermissionsProxy(stripeKey, rp)
+		if otlpEndpoint != "" {
+			provider, err := newTracerProvider(otlpEndpoint)
+			if err != nil {
+				return err
+			}
+			defer provider.Shutdown(context.Background())
+
+			// Trace context is continued from clients, but never sent on to
+			// Stripe.
+			opts = append(opts, proxy.WithTracing(provider, propagation.TraceContext{}))
+			rp.Transport = otelhttp.NewTransport(http.DefaultTransport,
+				otelhttp.WithTracerProvider(provider),
+				otelhttp.WithPropagators(propagation.NewCompositeTextMapPropagator()),
+				otelhttp.WithSpanNameFormatter(func(_ string, req *http.Request) string {
+					return "Stripe " + req.Method
+				}))
+			log.Infof("Exporting traces to %s", otlpEndpoint)
+		}
+		proxy := proxy.NewStripePermissionsProxy(stripeKey, keys, rp, opts...)
 
 		log.Infof("serve called with Stripe key: %s on %s", stripeKey, listenAddr)
 		if certificatePath != "" {
@@ -70,10 +195,148 @@ var serveCmd = &cobra.Command{
 	},
 }
 
+// keyringSource loads the keyring for verifying credentials. A keyring file is
+// watched so that rotated keys are picked up without a restart. Keyrings with
+// Ed25519 private keys are refused, since the proxy only needs the public
+// keys.
+func keyringSource() (proxy.KeyringSource, error) {
+	if keyringPath == "" {
+		keys, err := loadKeyring()
+		if err != nil {
+			return nil, err
+		}
+		if err := keys.CheckVerifyOnly(); err != nil {
+			return nil, err
+		}
+		warnSharedSecrets("$"+keyringEnv, keys)
+		return keys, nil
+	}
+
+	f, err := proxy.NewVerifyingKeyringFile(keyringPath)
+	if err != nil {
+		return nil, err
+	}
+	warnSharedSecrets(keyringPath, f.Keyring())
+	f.Watch(reloadInterval, func(err error) {
+		log.Errorf("Unable to reload keyring %s, continuing with previous keys: %s", keyringPath, err)
+	})
+	return f, nil
+}
+
+// warnSharedSecrets warns when the proxy is run with HMAC keys, which can
+// sign credentials as well as verify them.
+func warnSharedSecrets(name string, keys *proxy.Keyring) {
+	for _, key := range keys.Keys {
+		if key.Algorithm == proxy.AlgorithmHMACSHA256 {
+			log.Warnf("Keyring %s holds HMAC key %s, which can sign credentials as well as verify them, use Ed25519 keys so that the proxy only holds public keys", name, key.ID)
+			return
+		}
+	}
+}
+
+// loadUpstreams loads the named Stripe accounts, whose keyrings are watched
+// like the default keyring.
+func loadUpstreams(path string) (map[string]*proxy.Upstream, error) {
+	config, err := proxy.LoadUpstreamConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreams := map[string]*proxy.Upstream{}
+	for _, entry := range config.Upstreams {
+		keys, err := proxy.NewVerifyingKeyringFile(entry.Keyring)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load the keyring of upstream %s: %s", entry.Name, err)
+		}
+		warnSharedSecrets(entry.Keyring, keys.Keyring())
+		name, keyringPath := entry.Name, entry.Keyring
+		keys.Watch(reloadInterval, func(err error) {
+			log.Errorf("Unable to reload keyring %s of upstream %s, continuing with previous keys: %s", keyringPath, name, err)
+		})
+
+		upstreams[entry.Name] = &proxy.Upstream{
+			StripeKey: entry.StripeKey,
+			TestKey:   entry.TestStripeKey,
+			LiveKey:   entry.LiveStripeKey,
+			Keys:      keys,
+		}
+		log.Infof("Serving upstream %s with keyring %s", entry.Name, entry.Keyring)
+	}
+	return upstreams, nil
+}
+
+// openAuditLog writes the audit log to stdout for "-", and otherwise to a
+// file which is rotated by size. The log is signed with the audit keyring if
+// one is given.
+func openAuditLog() (proxy.AuditLog, func() error, error) {
+	var signer *proxy.AuditSigner
+	if auditKeyringPath != "" {
+		keys, err := proxy.NewKeyringFile(auditKeyringPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := keys.Keyring().SigningKey(); err != nil {
+			return nil, nil, fmt.Errorf("Unable to sign the audit log with %s: %s", auditKeyringPath, err)
+		}
+		keys.Watch(reloadInterval, func(err error) {
+			log.Errorf("Unable to reload audit keyring %s, continuing with previous keys: %s", auditKeyringPath, err)
+		})
+		signer = &proxy.AuditSigner{Keys: keys, Every: auditSignEvery}
+	}
+
+	if auditLogPath == "-" {
+		return proxy.NewAuditWriter(os.Stdout, signer), func() error { return nil }, nil
+	}
+	if auditLogMaxSize < 0 {
+		return nil, nil, errors.New("The --audit-log-max-size must not be negative")
+	}
+	audit, err := proxy.OpenAuditFile(auditLogPath, auditLogMaxSize*1024*1024, auditLogMaxBackups, signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return audit, audit.Close, nil
+}
+
+// newTracerProvider exports spans over OTLP/HTTP to the collector at the URL,
+// e.g. http://localhost:4318.
+func newTracerProvider(endpoint string) (*sdktrace.TracerProvider, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("The --otlp-endpoint must be an http or https URL, e.g. http://localhost:4318")
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "stripe-proxy"))),
+	), nil
+}
+
 func init() {
 	RootCmd.AddCommand(serveCmd)
 	serveCmd.Flags().StringVar(&upstreamURI, "uri", "https://api.stripe.com", "Upstream Stripe API URI to talk to.")
 	serveCmd.Flags().StringVar(&listenAddr, "listen", ":9090", "Interface and port on which to listen")
+	serveCmd.Flags().StringVar(&adminListenAddr, "admin-listen", "", "Interface and port on which to serve /metrics, separately from the proxy (default disabled)")
+	serveCmd.Flags().StringVar(&otlpEndpoint, "otlp-endpoint", "", "URL of the OpenTelemetry collector to export traces to over OTLP/HTTP, e.g. http://localhost:4318 (default disabled)")
 	serveCmd.Flags().StringVar(&certificatePath, "cert", "", "Path to the PEM encoded SSL certificate chain file")
 	serveCmd.Flags().StringVar(&privateKeyPath, "key", "", "Path to the PEM encoded SSL private key file")
+	serveCmd.Flags().DurationVar(&reloadInterval, "reload-interval", 10*time.Second, "How often to check the keyring and revocation files for changes")
+	serveCmd.Flags().StringVar(&budgetLedgerPath, "budget-ledger", "", "Path to the file which records the spending of credentials with a budget")
+	serveCmd.Flags().StringVar(&rateLimit, "rate-limit", "", "Rate of requests which each credential may make, e.g. 100/s (default unlimited)")
+	serveCmd.Flags().Int64Var(&maxInFlight, "max-in-flight", 0, "Number of requests which each credential may have in flight at once (default unlimited)")
+	serveCmd.Flags().StringVar(&testStripeKey, "test-stripekey", "", "Stripe test mode key for credentials signed with --mode test")
+	serveCmd.Flags().StringVar(&liveStripeKey, "live-stripekey", "", "Stripe live mode key for credentials signed with --mode live")
+	serveCmd.Flags().StringVar(&upstreamsPath, "upstreams", "", "Path to the JSON configuration of additional named Stripe accounts")
+	serveCmd.Flags().StringVar(&auditLogPath, "audit-log", "", "Path to the file which records every request as a line of JSON, or - for stdout")
+	serveCmd.Flags().Int64Var(&auditLogMaxSize, "audit-log-max-size", 100, "Size in megabytes at which the audit log is rotated, 0 to never rotate")
+	serveCmd.Flags().IntVar(&auditLogMaxBackups, "audit-log-max-backups", 5, "Number of rotated audit logs to keep")
+	serveCmd.Flags().StringVar(&auditKeyringPath, "audit-keyring", "", "Path to the keyring which periodically signs the audit log")
+	serveCmd.Flags().Uint64Var(&auditSignEvery, "audit-sign-every", 100, "Sign every Nth entry of the audit log")
+	serveCmd.Flags().BoolVar(&acceptLegacyCredentials, "accept-legacy-credentials", false, "Accept credentials signed with the Stripe key before signing keys were introduced")
 }
@@ -17,6 +17,8 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -25,29 +27,205 @@ import (
 )
 
 var inputToSign uint64
+var grantToSign string
+var ttl time.Duration
+var expires string
+var notBefore string
+var customers []string
+var accounts []string
+var maxAmount int64
+var currencies []string
+var budget int64
+var budgetWindow time.Duration
+var credentialRateLimit string
+var credentialMaxInFlight int64
+var credentialMode string
+var credentialUpstream string
 
 // signCmd represents the sign command
 var signCmd = &cobra.Command{
 	Use:   "sign",
-	Short: "Sign an integer which represents credentials to grant",
-	Long: `
+	Short: "Sign credentials which grant the specified permissions",
+	Long: `Sign credentials which grant the permissions specified with --grant, e.g.
+
+  --grant customers:read,charges:rw,refunds:create+update
+
+or with the integer representation of the permissions vector in --input.
+
+Credentials can be scoped to the objects of specific customers with --customer,
+and bound to connected accounts with --account. The money which they can move
+is limited with --max-amount and --currency, and over time with --budget.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
-		log.Infof("sign called with Stripe key: %s and input %b", stripeKey, inputToSign)
+		keys, err := loadKeyring()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
+		}
 
-		p := proxy.NewPermission(inputToSign)
-		signed, err := proxy.Sign(p, []byte(stripeKey))
+		signingKey, err := keys.SigningKey()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
+		}
+		claims, err := buildClaims(cmd)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(-1)
 		}
+		log.Infof("sign called with signing key: %s and permissions %s", signingKey.ID, claims.Permission)
+
+		signed, err := proxy.Sign(claims, keys)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
+		}
+		log.Infof("Credential ID: %s", claims.ID)
+		if !claims.Expires.IsZero() {
+			log.Infof("Credentials expire at %s", claims.Expires.Format(time.RFC3339))
+		}
 		log.Infof("Credentials:")
 		fmt.Printf("%s\n", signed)
 		log.Infof("Please copy and past the above credentials to your Stripe client")
 	},
 }
 
+func buildClaims(cmd *cobra.Command) (*proxy.Claims, error) {
+	permission, err := permissionFromFlags(cmd, grantToSign, inputToSign)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := proxy.NewCredentialID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	claims := &proxy.Claims{
+		ID:         id,
+		Permission: permission,
+		IssuedAt:   now,
+	}
+
+	claims.NotBefore, claims.Expires, err = validityWindow(now)
+	if err != nil {
+		return nil, err
+	}
+	if len(customers) > 0 {
+		claims.Customers = customers
+	}
+	if len(accounts) > 0 {
+		claims.Accounts = accounts
+	}
+	claims.MaxAmount, claims.Currencies = spendingLimits()
+	if budget != 0 {
+		claims.Budget, claims.BudgetWindow = budget, budgetWindow
+	}
+	if credentialRateLimit != "" {
+		claims.RateLimit, err = proxy.ParseRate(credentialRateLimit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	claims.MaxInFlight = credentialMaxInFlight
+	if credentialMode != "" {
+		claims.Mode, err = proxy.ParseMode(credentialMode)
+		if err != nil {
+			return nil, err
+		}
+	}
+	claims.Upstream = credentialUpstream
+	return claims, nil
+}
+
+// permissionFromFlags builds the permission from either the --grant grammar or
+// the --input vector.
+func permissionFromFlags(cmd *cobra.Command, grant string, input uint64) (*proxy.Permission, error) {
+	if cmd.Flags().Changed("grant") && cmd.Flags().Changed("input") {
+		return nil, fmt.Errorf("Only one of --grant and --input may be specified")
+	}
+	if cmd.Flags().Changed("grant") {
+		return proxy.ParsePermission(grant)
+	}
+	return proxy.NewPermission(input), nil
+}
+
+// validityWindow computes the not-before and expiry times from the flags
+// added by addValidityFlags.
+func validityWindow(now time.Time) (time.Time, time.Time, error) {
+	var start, end time.Time
+
+	if ttl != 0 && expires != "" {
+		return start, end, fmt.Errorf("Only one of --ttl and --expires may be specified")
+	}
+	if ttl < 0 {
+		return start, end, fmt.Errorf("The --ttl must be positive")
+	}
+	if ttl != 0 {
+		end = now.Add(ttl)
+	}
+	if expires != "" {
+		t, err := time.Parse(time.RFC3339, expires)
+		if err != nil {
+			return start, end, fmt.Errorf("Unable to parse --expires: %s", err)
+		}
+		end = t
+	}
+	if notBefore != "" {
+		t, err := time.Parse(time.RFC3339, notBefore)
+		if err != nil {
+			return start, end, fmt.Errorf("Unable to parse --not-before: %s", err)
+		}
+		start = t
+	}
+
+	if !end.IsZero() && !end.After(now) {
+		return start, end, fmt.Errorf("Credentials would already be expired at %s", end.Format(time.RFC3339))
+	}
+	if !end.IsZero() && !start.Before(end) {
+		return start, end, fmt.Errorf("The --not-before time must be before the expiry")
+	}
+
+	return start, end, nil
+}
+
+func addValidityFlags(cmd *cobra.Command) {
+	cmd.Flags().DurationVar(&ttl, "ttl", 0, "Duration after which the credentials expire, e.g. 720h (default never)")
+	cmd.Flags().StringVar(&expires, "expires", "", "RFC 3339 time at which the credentials expire (default never)")
+	cmd.Flags().StringVar(&notBefore, "not-before", "", "RFC 3339 time before which the credentials are not valid")
+}
+
+// spendingLimits reads the flags added by addLimitFlags.
+func spendingLimits() (int64, []string) {
+	var lower []string
+	for _, currency := range currencies {
+		lower = append(lower, strings.ToLower(currency))
+	}
+	return maxAmount, lower
+}
+
+func addLimitFlags(cmd *cobra.Command) {
+	cmd.Flags().Int64Var(&maxAmount, "max-amount", 0, "Maximum amount of each charge, refund, transfer, payout and payment intent, in the currency's smallest unit (default unlimited)")
+	cmd.Flags().StringSliceVar(&currencies, "currency", nil, "Currency which charges, transfers, payouts and payment intents may use, may be repeated (default any)")
+}
+
+func addScopeFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVar(&customers, "customer", nil, "Customer ID to restrict the credentials to, may be repeated")
+	cmd.Flags().StringSliceVar(&accounts, "account", nil, "Connected account ID to bind the credentials to, may be repeated")
+}
+
 func init() {
 	RootCmd.AddCommand(signCmd)
 	signCmd.Flags().Uint64Var(&inputToSign, "input", 1, "Integer representation of permissions vector")
+	signCmd.Flags().StringVar(&grantToSign, "grant", "", "Comma separated resource:access grants, e.g. customers:read,charges:rw")
+	addValidityFlags(signCmd)
+	addScopeFlags(signCmd)
+	addLimitFlags(signCmd)
+	signCmd.Flags().Int64Var(&budget, "budget", 0, "Total amount which the credentials may spend within each --budget-window, in their single --currency (default unlimited)")
+	signCmd.Flags().StringVar(&credentialMode, "mode", "", "Whether the credentials use the proxy's test or live Stripe key (default the proxy's --stripekey)")
+	signCmd.Flags().StringVar(&credentialUpstream, "upstream", "", "Name of the proxy's Stripe account which the credentials target, signed with that account's --keyring (default the proxy's own)")
+	signCmd.Flags().StringVar(&credentialRateLimit, "rate-limit", "", "Rate of requests which the credentials may make, e.g. 100/s or 600/m (default unlimited)")
+	signCmd.Flags().Int64Var(&credentialMaxInFlight, "max-in-flight", 0, "Number of requests which the credentials may have in flight at once (default unlimited)")
+	signCmd.Flags().DurationVar(&budgetWindow, "budget-window", 24*time.Hour, "Rolling window of the --budget, up to 744h")
 }
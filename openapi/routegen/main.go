@@ -0,0 +1,417 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command routegen generates the resource enum and route table of the proxy
+// from Stripe's OpenAPI specification and the resource registry.
+//
+// The registry assigns every resource a stable ID, which is its position in
+// the permission bitset, and lists the path prefixes which belong to it. Each
+// path in the specification is assigned to the resource with the longest
+// matching prefix, and paths which no resource claims are reported and left
+// to the ResourceAll fallback.
+//
+// The operation of each method is taken from the x-stripeOperations
+// annotations of the SDK flavour of the specification, and otherwise guessed
+// from the shape of the path.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+type resource struct {
+	ID    int      `json:"id"`
+	Const string   `json:"const"`
+	Name  string   `json:"name"`
+	Group string   `json:"group"`
+	Paths []string `json:"paths"`
+}
+
+type registry struct {
+	Resources []*resource `json:"resources"`
+}
+
+type stripeOperation struct {
+	MethodType string `json:"method_type"`
+	Operation  string `json:"operation"`
+	Path       string `json:"path"`
+}
+
+type spec struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Operations []stripeOperation `json:"x-stripeOperations"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+// annotations maps each annotated method and path to its method type.
+func (s *spec) annotations() map[string]string {
+	types := map[string]string{}
+	for _, schema := range s.Components.Schemas {
+		for _, op := range schema.Operations {
+			types[strings.ToLower(op.Operation)+" "+op.Path] = op.MethodType
+		}
+	}
+	return types
+}
+
+type route struct {
+	Path     string
+	Method   string
+	Access   string
+	Resource *resource
+}
+
+// methods are the operations of the specification, in the order that routes
+// for the same path are emitted.
+var methods = []string{"get", "head", "post", "put", "patch", "delete"}
+
+func methodOrder(method string) int {
+	for i, m := range methods {
+		if strings.EqualFold(m, method) {
+			return i
+		}
+	}
+	return len(methods)
+}
+
+// methodTypeAccess maps the method types of the x-stripeOperations
+// annotations to the access constant which they require.
+var methodTypeAccess = map[string]string{
+	"list":     "List",
+	"search":   "List",
+	"retrieve": "Retrieve",
+	"create":   "Create",
+	"update":   "Update",
+	"delete":   "Delete",
+}
+
+// operationAccess finds the access which a method on a path requires. Custom
+// operations are actions such as capturing a charge, which read or update
+// the object depending on the method. Operations without an annotation are
+// guessed from whether the path ends in an object ID, and reported.
+func operationAccess(method, path, methodType string) (string, bool) {
+	if access, ok := methodTypeAccess[methodType]; ok {
+		return access, true
+	}
+
+	annotated := methodType != ""
+	segs := segments(path)
+	item := isVariable(segs[len(segs)-1])
+	switch {
+	case method == "delete":
+		return "Delete", annotated
+	case method == "get" || method == "head":
+		if item || annotated {
+			return "Retrieve", annotated
+		}
+		return "List", false
+	case item || annotated:
+		return "Update", annotated
+	default:
+		return "Create", false
+	}
+}
+
+func segments(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+func isVariable(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// hasPrefix reports whether the path segments start with the prefix
+// segments, where a variable matches any other variable.
+func hasPrefix(path, prefix []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if isVariable(prefix[i]) && isVariable(path[i]) {
+			continue
+		}
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// moreSpecific orders longer paths first, and literal segments before
+// variables so that e.g. /v1/invoices/upcoming matches before
+// /v1/invoices/{invoice}.
+func moreSpecific(a, b string) bool {
+	as, bs := segments(a), segments(b)
+	if len(as) != len(bs) {
+		return len(as) > len(bs)
+	}
+	for i := range as {
+		if as[i] == bs[i] {
+			continue
+		}
+		if isVariable(as[i]) != isVariable(bs[i]) {
+			return !isVariable(as[i])
+		}
+		return as[i] < bs[i]
+	}
+	return false
+}
+
+func (r *registry) validate() error {
+	ids := map[int]bool{}
+	consts := map[string]bool{}
+	names := map[string]bool{}
+	prefixes := map[string]string{}
+
+	for _, res := range r.Resources {
+		if res.ID < 0 || res.Const == "" || res.Name == "" {
+			return fmt.Errorf("Resource %q must have an ID, const and name", res.Const)
+		}
+		if ids[res.ID] || consts[res.Const] || names[res.Name] {
+			return fmt.Errorf("Resource %q reuses an ID, const or name", res.Const)
+		}
+		ids[res.ID], consts[res.Const], names[res.Name] = true, true, true
+
+		for _, prefix := range res.Paths {
+			if !strings.HasPrefix(prefix, "/v1/") {
+				return fmt.Errorf("Path %q of %s must start with /v1/", prefix, res.Const)
+			}
+			key := strings.Join(normalize(segments(prefix)), "/")
+			if other, ok := prefixes[key]; ok {
+				return fmt.Errorf("Path %q is claimed by both %s and %s", prefix, other, res.Const)
+			}
+			prefixes[key] = res.Const
+		}
+	}
+
+	if len(r.Resources) == 0 || r.Resources[0].ID != 0 || len(r.Resources[0].Paths) != 0 {
+		return fmt.Errorf("The first resource must be the fallback with ID 0 and no paths")
+	}
+	return nil
+}
+
+func normalize(segs []string) []string {
+	normalized := make([]string, len(segs))
+	for i, seg := range segs {
+		if isVariable(seg) {
+			seg = "{}"
+		}
+		normalized[i] = seg
+	}
+	return normalized
+}
+
+// classify finds the resource with the longest prefix of the path.
+func (r *registry) classify(path string) *resource {
+	var best *resource
+	bestLength := 0
+
+	segs := segments(path)
+	for _, res := range r.Resources {
+		for _, prefix := range res.Paths {
+			prefixSegs := segments(prefix)
+			if hasPrefix(segs, prefixSegs) && len(prefixSegs) > bestLength {
+				best, bestLength = res, len(prefixSegs)
+			}
+		}
+	}
+	return best
+}
+
+// routes builds the route table, most specific path first. The paths which
+// no resource claims, and the operations whose access had to be guessed, are
+// returned separately.
+func routes(reg *registry, s *spec) ([]route, []string, []string) {
+	var result []route
+	var unclaimed, guessed []string
+
+	annotations := s.annotations()
+
+	for path, operations := range s.Paths {
+		res := reg.classify(path)
+		if res == nil {
+			unclaimed = append(unclaimed, path)
+			continue
+		}
+
+		for method := range operations {
+			if methodOrder(method) == len(methods) {
+				// Not an operation, e.g. shared parameters
+				continue
+			}
+
+			access, ok := operationAccess(method, path, annotations[method+" "+path])
+			if !ok {
+				guessed = append(guessed, strings.ToUpper(method)+" "+path)
+			}
+			result = append(result, route{path, strings.ToUpper(method), access, res})
+
+			// HEAD is served wherever GET is
+			if method == "get" {
+				if _, ok := operations["head"]; !ok {
+					result = append(result, route{path, "HEAD", access, res})
+				}
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Path != result[j].Path {
+			return moreSpecific(result[i].Path, result[j].Path)
+		}
+		return methodOrder(result[i].Method) < methodOrder(result[j].Method)
+	})
+	sort.Strings(unclaimed)
+	sort.Strings(guessed)
+
+	return result, unclaimed, guessed
+}
+
+var output = template.Must(template.New("output").Parse(`// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Code generated by routegen from {{.Spec}} and {{.Registry}}. DO NOT EDIT.
+
+package proxy
+
+// Note: these do not use iota so that they are stable through modifications
+// of the list.
+const (
+{{- range $i, $r := .Resources}}
+{{- if eq $i 0}}
+	{{$r.Const}} StripeResource = {{$r.ID}}
+{{- else}}
+{{- if index $.GroupStarts $i}}
+
+	// {{$r.Group}}
+{{- end}}
+	{{$r.Const}} = {{$r.ID}}
+{{- end}}
+{{- end}}
+)
+
+// resourceNames are how resources are written in the permission grammar,
+// following the Stripe API paths where possible.
+var resourceNames = map[StripeResource]string{
+{{- range .Resources}}
+	{{.Const}}: "{{.Name}}",
+{{- end}}
+}
+
+// resourceRoutes are matched in order, most specific path first.
+var resourceRoutes = []resourceRoute{
+{{- range .Routes}}
+	{"{{.Path}}", "{{.Method}}", {{.Access}}, {{.Resource.Const}}},
+{{- end}}
+}
+`))
+
+func readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Unable to parse %s: %s", path, err)
+	}
+	return nil
+}
+
+func generate(specPath, registryPath string) ([]byte, error) {
+	reg := &registry{}
+	if err := readJSON(registryPath, reg); err != nil {
+		return nil, err
+	}
+	if err := reg.validate(); err != nil {
+		return nil, err
+	}
+
+	s := &spec{}
+	if err := readJSON(specPath, s); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(reg.Resources, func(i, j int) bool {
+		return reg.Resources[i].ID < reg.Resources[j].ID
+	})
+
+	table, unclaimed, guessed := routes(reg, s)
+	for _, path := range unclaimed {
+		fmt.Fprintf(os.Stderr, "routegen: %s is not claimed by any resource, it requires access to all\n", path)
+	}
+	for _, operation := range guessed {
+		fmt.Fprintf(os.Stderr, "routegen: %s has no x-stripeOperations annotation, its operation was guessed\n", operation)
+	}
+
+	// A comment is emitted above the first resource of each group
+	groupStarts := make([]bool, len(reg.Resources))
+	for i := 1; i < len(reg.Resources); i++ {
+		groupStarts[i] = reg.Resources[i].Group != reg.Resources[i-1].Group
+	}
+
+	var buf bytes.Buffer
+	err := output.Execute(&buf, map[string]interface{}{
+		"Spec":        filepath.ToSlash(specPath),
+		"Registry":    filepath.ToSlash(registryPath),
+		"Resources":   reg.Resources,
+		"GroupStarts": groupStarts,
+		"Routes":      table,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
+
+func main() {
+	specPath := flag.String("spec", "spec3.sdk.json", "Path to Stripe's OpenAPI specification")
+	registryPath := flag.String("registry", "resources.json", "Path to the resource registry")
+	outputPath := flag.String("output", "resources_gen.go", "Path of the generated Go file")
+	flag.Parse()
+
+	source, err := generate(*specPath, *registryPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "routegen: %s\n", err)
+		os.Exit(1)
+	}
+
+	if err := ioutil.WriteFile(*outputPath, source, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "routegen: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	all := &resource{ID: 0, Const: "ResourceAll", Name: "all"}
+	accounts := &resource{ID: 1, Const: "ResourceAccount", Name: "accounts", Paths: []string{"/v1/accounts"}}
+	external := &resource{ID: 2, Const: "ResourceExternalAccount", Name: "external_accounts", Paths: []string{"/v1/accounts/{id}/external_accounts"}}
+	reg := &registry{[]*resource{all, accounts, external}}
+	assert.Nil(reg.validate())
+
+	op := json.RawMessage(`{}`)
+	s := &spec{Paths: map[string]map[string]json.RawMessage{
+		"/v1/accounts":                                  {"get": op, "post": op},
+		"/v1/accounts/{account}":                        {"get": op, "delete": op, "parameters": op},
+		"/v1/accounts/search":                           {"get": op},
+		"/v1/accounts/{account}/external_accounts":      {"post": op},
+		"/v1/accounts/{account}/external_accounts/{id}": {"delete": op},
+		"/v1/radar/value_lists":                         {"get": op},
+	}}
+
+	s.Components.Schemas = map[string]struct {
+		Operations []stripeOperation `json:"x-stripeOperations"`
+	}{
+		"account": {[]stripeOperation{
+			{"search", "get", "/v1/accounts/search"},
+			{"custom", "get", "/v1/accounts/{account}"},
+			{"create", "post", "/v1/accounts/{account}/external_accounts"},
+		}},
+	}
+
+	table, unclaimed, guessed := routes(reg, s)
+	assert.Equal([]string{"/v1/radar/value_lists"}, unclaimed)
+	assert.Equal([]string{
+		"DELETE /v1/accounts/{account}",
+		"DELETE /v1/accounts/{account}/external_accounts/{id}",
+		"GET /v1/accounts",
+		"POST /v1/accounts",
+	}, guessed)
+	assert.Equal([]route{
+		{"/v1/accounts/{account}/external_accounts/{id}", "DELETE", "Delete", external},
+		{"/v1/accounts/{account}/external_accounts", "POST", "Create", external},
+		{"/v1/accounts/search", "GET", "List", accounts},
+		{"/v1/accounts/search", "HEAD", "List", accounts},
+		{"/v1/accounts/{account}", "GET", "Retrieve", accounts},
+		{"/v1/accounts/{account}", "HEAD", "Retrieve", accounts},
+		{"/v1/accounts/{account}", "DELETE", "Delete", accounts},
+		{"/v1/accounts", "GET", "List", accounts},
+		{"/v1/accounts", "HEAD", "List", accounts},
+		{"/v1/accounts", "POST", "Create", accounts},
+	}, table)
+}
+
+func TestInvalidRegistry(t *testing.T) {
+	assert := assert.New(t)
+
+	all := &resource{ID: 0, Const: "ResourceAll", Name: "all"}
+	for _, resources := range [][]*resource{
+		// Missing the fallback
+		{{ID: 1, Const: "ResourceAccount", Name: "accounts"}},
+		// Reused ID
+		{all, {ID: 0, Const: "ResourceAccount", Name: "accounts"}},
+		// Reused name
+		{all, {ID: 1, Const: "ResourceAccount", Name: "all"}},
+		// Path outside of the API
+		{all, {ID: 1, Const: "ResourceAccount", Name: "accounts", Paths: []string{"/accounts"}}},
+		// Path claimed twice
+		{
+			all,
+			{ID: 1, Const: "ResourceAccount", Name: "accounts", Paths: []string{"/v1/accounts/{a}"}},
+			{ID: 2, Const: "ResourcePerson", Name: "persons", Paths: []string{"/v1/accounts/{b}"}},
+		},
+	} {
+		assert.NotNil((&registry{resources}).validate())
+	}
+}
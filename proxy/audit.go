@@ -0,0 +1,271 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit decisions
+const (
+	DecisionAllowed = "allowed"
+	DecisionDenied  = "denied"
+)
+
+// stripeRequestIDHeader identifies a request in Stripe's dashboard and logs.
+const stripeRequestIDHeader = "Request-Id"
+
+// AuditEvent describes the outcome of a single request.
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+
+	// CredentialID is only set once the credential has been verified, while
+	// the fingerprint identifies any credential, including legacy ones.
+	CredentialID string `json:"credential_id,omitempty"`
+	Fingerprint  string `json:"fingerprint,omitempty"`
+	Upstream     string `json:"upstream,omitempty"`
+
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Resource string `json:"resource"`
+	Decision string `json:"decision"`
+	Reason   string `json:"reason,omitempty"`
+
+	// Status is Stripe's response to forwarded requests and the proxy's own
+	// to denied ones.
+	Status    int    `json:"status"`
+	RequestID string `json:"request_id,omitempty"`
+
+	// Each event is numbered and includes the hash of the one before it, so
+	// that entries can't be changed, removed or reordered unnoticed. Some
+	// are also signed, see AuditSigner.
+	Sequence  uint64 `json:"seq"`
+	PrevHash  string `json:"prev_hash"`
+	Hash      string `json:"hash,omitempty"`
+	KeyID     string `json:"key_id,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// AuditLog records an event for every request which the proxy handles.
+type AuditLog interface {
+	Record(event *AuditEvent) error
+}
+
+// WithAuditLog records every request in the log. Errors while recording are
+// passed to onError, since the request has already been answered.
+func WithAuditLog(log AuditLog, onError func(error)) Option {
+	return func(p *permissionsProxy) {
+		p.audit = log
+		p.onAuditError = onError
+	}
+}
+
+// CredentialFingerprint identifies a credential in the audit log without
+// revealing it.
+func CredentialFingerprint(credentials string) string {
+	sum := sha256.Sum256([]byte(credentials))
+	return hex.EncodeToString(sum[:8])
+}
+
+// statusResponseWriter keeps the status of the response for the audit log,
+// metrics and traces.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// complete fills in the event from the response and records it in the audit
+// log, if there is one.
+func (p *permissionsProxy) complete(event *AuditEvent, w *statusResponseWriter) {
+	event.Status = w.status
+	if event.Status == 0 {
+		event.Status = http.StatusOK
+	}
+	event.RequestID = w.Header().Get(stripeRequestIDHeader)
+
+	if p.audit == nil {
+		return
+	}
+	if err := p.audit.Record(event); err != nil && p.onAuditError != nil {
+		p.onAuditError(err)
+	}
+}
+
+// AuditWriter is an AuditLog which writes each event as a line of JSON, e.g.
+// to stdout. Its hash chain starts anew with each writer.
+type AuditWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	chain auditChain
+}
+
+// NewAuditWriter writes the events to w, signing them periodically if the
+// signer is not nil.
+func NewAuditWriter(w io.Writer, signer *AuditSigner) *AuditWriter {
+	return &AuditWriter{w: w, chain: auditChain{signer: signer}}
+}
+
+func (a *AuditWriter) Record(event *AuditEvent) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	data, linkErr := a.chain.link(event)
+	if data == nil {
+		return linkErr
+	}
+	if _, err := a.w.Write(data); err != nil {
+		return err
+	}
+	return linkErr
+}
+
+// AuditFile is an AuditLog which appends each event as a line of JSON to a
+// file. Once the file would grow beyond its maximum size it is rotated to
+// path.1, shifting older files up to path.N for N backups and deleting the
+// oldest. The hash chain continues across rotated files and restarts.
+type AuditFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	chain      auditChain
+}
+
+// OpenAuditFile appends to the specified file, creating it if necessary, and
+// signs the events periodically if the signer is not nil. A maxSize of 0
+// never rotates the file.
+func OpenAuditFile(path string, maxSize int64, maxBackups int, signer *AuditSigner) (*AuditFile, error) {
+	if maxSize < 0 || maxBackups < 0 {
+		return nil, fmt.Errorf("Audit log size and backups must not be negative")
+	}
+
+	a := &AuditFile{path: path, maxSize: maxSize, maxBackups: maxBackups, chain: auditChain{signer: signer}}
+
+	// The current file is only empty right after it was rotated
+	last, err := lastAuditEvent(path)
+	if err == nil && last == nil {
+		last, err = lastAuditEvent(backupPath(path, 1))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if last != nil {
+		a.chain.resume(last)
+	}
+
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditFile) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file, a.size = f, info.Size()
+	return nil
+}
+
+func (a *AuditFile) Record(event *AuditEvent) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	data, linkErr := a.chain.link(event)
+	if data == nil {
+		return linkErr
+	}
+
+	var rotateErr error
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.maxSize {
+		rotateErr = a.rotate()
+	}
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+	if rotateErr != nil {
+		return fmt.Errorf("Unable to rotate audit log %s: %s", a.path, rotateErr)
+	}
+	if err != nil {
+		return err
+	}
+	return linkErr
+}
+
+// rotate moves the current file to the first backup and starts a new one.
+// The current file is only closed once the new one is open, so that the log
+// always has a file to write to and events are never lost.
+func (a *AuditFile) rotate() error {
+	if err := a.shiftBackups(); err != nil {
+		return err
+	}
+	previous := a.file
+	if err := a.open(); err != nil {
+		return err
+	}
+	return previous.Close()
+}
+
+func (a *AuditFile) shiftBackups() error {
+	if a.maxBackups == 0 {
+		return os.Remove(a.path)
+	}
+	for i := a.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(backupPath(a.path, i), backupPath(a.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(a.path, backupPath(a.path, 1))
+}
+
+func backupPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// Close closes the audit log file.
+func (a *AuditFile) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
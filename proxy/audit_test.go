@@ -0,0 +1,183 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// requestIDUpstream answers every request with a Stripe request ID.
+type requestIDUpstream struct{}
+
+func (u *requestIDUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set(stripeRequestIDHeader, "req_123")
+	rw.WriteHeader(201)
+	fmt.Fprint(rw, `{"id": "re_123"}`)
+}
+
+func readAuditEvents(t *testing.T, data []byte) []AuditEvent {
+	var events []AuditEvent
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var event AuditEvent
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestAuditLog(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	keys := newTestKeyring()
+	proxy := NewStripePermissionsProxy(proxyTestStripeKey, keys, &requestIDUpstream{}, WithAuditLog(NewAuditWriter(&buf, nil), nil))
+
+	claims := &Claims{ID: "audited", Permission: &Permission{}}
+	claims.Permission.SetAccess(Create, ResourceRefunds)
+	signed, err := Sign(claims, keys)
+	assert.Nil(err)
+
+	serve := func(credentials, method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.SetBasicAuth(credentials, "")
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	assert.Equal(201, serve(signed, "POST", "/v1/refunds"))
+	assert.Equal(403, serve(signed, "DELETE", "/v1/customers/cus_123"))
+	assert.Equal(403, serve("forged", "GET", "/v1/charges"))
+
+	events := readAuditEvents(t, buf.Bytes())
+	if !assert.Len(events, 3) {
+		return
+	}
+
+	allowed := events[0]
+	assert.Equal("audited", allowed.CredentialID)
+	assert.Equal(CredentialFingerprint(signed), allowed.Fingerprint)
+	assert.Equal("POST", allowed.Method)
+	assert.Equal("/v1/refunds", allowed.Path)
+	assert.Equal("refunds", allowed.Resource)
+	assert.Equal(DecisionAllowed, allowed.Decision)
+	assert.Equal(201, allowed.Status)
+	assert.Equal("req_123", allowed.RequestID)
+	assert.False(allowed.Time.IsZero())
+
+	denied := events[1]
+	assert.Equal("audited", denied.CredentialID)
+	assert.Equal("customers", denied.Resource)
+	assert.Equal(DecisionDenied, denied.Decision)
+	assert.Equal("Request requires permission that was not granted", denied.Reason)
+	assert.Equal(403, denied.Status)
+	assert.Empty(denied.RequestID)
+
+	// Unverified credentials are only identified by their fingerprint
+	forged := events[2]
+	assert.Empty(forged.CredentialID)
+	assert.Equal(CredentialFingerprint("forged"), forged.Fingerprint)
+	assert.Equal(DecisionDenied, forged.Decision)
+	assert.NotEmpty(forged.Reason)
+
+	// The fingerprint doesn't reveal the credential
+	assert.Len(allowed.Fingerprint, 16)
+	assert.NotContains(buf.String(), signed)
+}
+
+func TestAuditFileRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// Lines are as long as the linked events, apart from the first which
+	// has no previous hash.
+	event := &AuditEvent{Method: "GET", Path: "/v1/charges", Resource: "charges", Decision: DecisionAllowed, Status: 200}
+	linked := *event
+	linked.Sequence, linked.PrevHash, linked.Hash = 1, strings.Repeat("0", 64), strings.Repeat("0", 64)
+	line, err := json.Marshal(linked)
+	assert.Nil(err)
+
+	// Each file holds two events
+	path := filepath.Join(dir, "audit.jsonl")
+	audit, err := OpenAuditFile(path, int64(2*(len(line)+1)), 2, nil)
+	assert.Nil(err)
+	for i := 0; i < 7; i++ {
+		event.Status = 200 + i
+		assert.Nil(audit.Record(event))
+	}
+	assert.Nil(audit.Close())
+
+	statuses := func(path string) []int {
+		data, err := ioutil.ReadFile(path)
+		assert.Nil(err)
+		var result []int
+		for _, event := range readAuditEvents(t, data) {
+			result = append(result, event.Status)
+		}
+		return result
+	}
+	assert.Equal([]int{206}, statuses(path))
+	assert.Equal([]int{204, 205}, statuses(path+".1"))
+	assert.Equal([]int{202, 203}, statuses(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(os.IsNotExist(err))
+
+	// Reopening appends to the current file
+	audit, err = OpenAuditFile(path, 0, 0, nil)
+	assert.Nil(err)
+	assert.Nil(audit.Record(event))
+	assert.Nil(audit.Close())
+	assert.Equal([]int{206, 206}, statuses(path))
+
+	// Without backups the file starts over
+	audit, err = OpenAuditFile(path, int64(len(line)+1), 0, nil)
+	assert.Nil(err)
+	event.Status = 500
+	assert.Nil(audit.Record(event))
+	assert.Nil(audit.Close())
+	assert.Equal([]int{500}, statuses(path))
+	assert.Equal([]int{204, 205}, statuses(path+".1"))
+
+	// Failing to rotate keeps appending to the current file
+	assert.Nil(os.Remove(path + ".1"))
+	assert.Nil(os.MkdirAll(filepath.Join(path+".1", "busy"), 0700))
+	audit, err = OpenAuditFile(path, int64(len(line)+1), 1, nil)
+	assert.Nil(err)
+	event.Status = 501
+	assert.NotNil(audit.Record(event))
+	event.Status = 502
+	assert.NotNil(audit.Record(event))
+	assert.Nil(audit.Close())
+	assert.Equal([]int{500, 501, 502}, statuses(path))
+
+	_, err = OpenAuditFile(path, -1, 0, nil)
+	assert.NotNil(err)
+}
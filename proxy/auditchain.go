@@ -0,0 +1,254 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// auditSignatureContext is prepended to the hashes which are signed, so that
+// an audit signature can never pass for the signature of a credential.
+const auditSignatureContext = "stripe-proxy audit log\n"
+
+// maxAuditLineLength bounds the lines which are read back from audit logs.
+const maxAuditLineLength = 1024 * 1024
+
+// AuditSigner periodically signs the hash chain of an audit log with the
+// current signing key of its keyring, so that the log can't be rewritten by
+// someone without the key.
+type AuditSigner struct {
+	Keys KeyringSource
+
+	// Every signs each entry whose sequence number is a multiple of it.
+	Every uint64
+}
+
+// auditChain links each event of an audit log to the one before it.
+type auditChain struct {
+	signer *AuditSigner
+	next   uint64
+	prev   string
+}
+
+// resume continues the chain after the last event of an existing log.
+func (c *auditChain) resume(last *AuditEvent) {
+	c.next = last.Sequence + 1
+	c.prev = last.Hash
+}
+
+// link numbers and hashes a copy of the event, and signs it when due. The
+// entry is returned even if it could not be signed.
+func (c *auditChain) link(event *AuditEvent) ([]byte, error) {
+	linked := *event
+	linked.Sequence = c.next
+	linked.PrevHash = c.prev
+	hash, err := auditHash(linked)
+	if err != nil {
+		return nil, err
+	}
+	linked.Hash = hash
+
+	var signErr error
+	if c.signer != nil && c.signer.Every > 0 && linked.Sequence%c.signer.Every == 0 {
+		signErr = signAuditEvent(&linked, c.signer.Keys.Keyring())
+	}
+
+	data, err := json.Marshal(linked)
+	if err != nil {
+		return nil, err
+	}
+	c.next, c.prev = linked.Sequence+1, linked.Hash
+	if signErr != nil {
+		return append(data, '\n'), fmt.Errorf("Unable to sign audit entry %d: %s", linked.Sequence, signErr)
+	}
+	return append(data, '\n'), nil
+}
+
+// auditHash hashes the JSON encoding of the event without its own hash and
+// signature, which includes the hash of the previous event.
+func auditHash(event AuditEvent) (string, error) {
+	event.Hash, event.KeyID, event.Signature = "", "", ""
+	data, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func signAuditEvent(event *AuditEvent, keys *Keyring) error {
+	key, err := keys.SigningKey()
+	if err != nil {
+		return err
+	}
+	signature, err := key.sign([]byte(auditSignatureContext + event.Hash))
+	if err != nil {
+		return err
+	}
+	event.KeyID = key.ID
+	event.Signature = base64.RawStdEncoding.EncodeToString(signature)
+	return nil
+}
+
+// lastAuditEvent reads the last event of an audit log, or nil if there is
+// none.
+func lastAuditEvent(path string) (*AuditEvent, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var last []byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxAuditLineLength)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if last == nil {
+		return nil, nil
+	}
+
+	var event AuditEvent
+	if err := json.Unmarshal(last, &event); err != nil {
+		return nil, fmt.Errorf("Unable to continue the hash chain of audit log %s: %s", path, err)
+	}
+	return &event, nil
+}
+
+// AuditLinkError reports the first entry which breaks the hash chain.
+type AuditLinkError struct {
+	Path     string
+	Line     int
+	Sequence uint64
+	Reason   string
+}
+
+func (e *AuditLinkError) Error() string {
+	return fmt.Sprintf("%s:%d: entry %d %s", e.Path, e.Line, e.Sequence, e.Reason)
+}
+
+// AuditVerifier checks the hash chain of audit logs, and the signatures in
+// them if it has a keyring. The chain continues across the logs which are
+// verified in turn, from the oldest rotated log to the current one.
+type AuditVerifier struct {
+	Keys *Keyring
+
+	// Entries and Signatures count what has been verified so far. A chain
+	// which doesn't start at entry 0 starts at FirstSequence, since the
+	// logs before it have been rotated away.
+	Entries       int
+	Signatures    int
+	FirstSequence uint64
+	LastSigned    *uint64
+
+	started bool
+	next    uint64
+	prev    string
+}
+
+// Verify walks the log and returns an AuditLinkError for the first entry
+// which doesn't match its hash, doesn't link to the previous entry or has an
+// invalid signature.
+func (v *AuditVerifier) Verify(path string, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxAuditLineLength)
+	line := 0
+	for scanner.Scan() {
+		line++
+		broken := func(event *AuditEvent, reason string, args ...interface{}) error {
+			return &AuditLinkError{path, line, event.Sequence, fmt.Sprintf(reason, args...)}
+		}
+
+		var event AuditEvent
+		dec := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&event); err != nil {
+			return broken(&AuditEvent{Sequence: v.next}, "is malformed: %s", err)
+		}
+
+		switch {
+		case v.started && event.Sequence != v.next:
+			return broken(&event, "follows entry %d", v.next-1)
+		case v.started && event.PrevHash != v.prev:
+			return broken(&event, "does not link to the previous entry")
+		case !v.started && event.Sequence == 0 && event.PrevHash != "":
+			return broken(&event, "starts the chain but links to a previous entry")
+		}
+
+		hash, err := auditHash(event)
+		if err != nil {
+			return err
+		}
+		if hash != event.Hash {
+			return broken(&event, "does not match its hash")
+		}
+
+		if event.Signature != "" && v.Keys != nil {
+			key, ok := v.Keys.Lookup(event.KeyID)
+			if !ok {
+				return broken(&event, "was signed with unknown key %s", event.KeyID)
+			}
+			signature, err := base64.RawStdEncoding.DecodeString(event.Signature)
+			if err != nil || !key.verify([]byte(auditSignatureContext+event.Hash), signature) {
+				return broken(&event, "has an invalid signature")
+			}
+			signed := event.Sequence
+			v.LastSigned = &signed
+			v.Signatures++
+		}
+
+		if !v.started {
+			v.FirstSequence = event.Sequence
+			v.started = true
+		}
+		v.Entries++
+		v.next, v.prev = event.Sequence+1, event.Hash
+	}
+	return scanner.Err()
+}
+
+// CheckSigned returns an error unless the entries verified so far are covered
+// by signatures, apart from fewer than every entries after the last signed
+// one, which haven't been due a signature yet.
+func (v *AuditVerifier) CheckSigned(every uint64) error {
+	if v.Entries == 0 {
+		return nil
+	}
+	if v.LastSigned == nil {
+		return errors.New("No entry is signed, so the whole chain could have been rewritten")
+	}
+	last := v.FirstSequence + uint64(v.Entries) - 1
+	if unsigned := last - *v.LastSigned; unsigned >= every {
+		return fmt.Errorf("The %d entries after the last signature exceed the signing interval of %d, so they could have been rewritten", unsigned, every)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func verifyAuditLines(keys *Keyring, lines []string) (*AuditVerifier, error) {
+	v := &AuditVerifier{Keys: keys}
+	return v, v.Verify("audit.jsonl", strings.NewReader(strings.Join(lines, "")))
+}
+
+func TestAuditChain(t *testing.T) {
+	assert := assert.New(t)
+
+	keys := newTestKeyring()
+	var buf bytes.Buffer
+	audit := NewAuditWriter(&buf, &AuditSigner{Keys: keys, Every: 2})
+	for i := 0; i < 5; i++ {
+		assert.Nil(audit.Record(&AuditEvent{Method: "GET", Path: "/v1/charges", Resource: "charges", Decision: DecisionAllowed, Status: 200 + i}))
+	}
+
+	lines := strings.SplitAfter(buf.String(), "\n")
+	lines = lines[:len(lines)-1]
+	events := readAuditEvents(t, buf.Bytes())
+	assert.Len(events, 5)
+	for i, event := range events {
+		assert.Equal(uint64(i), event.Sequence)
+		assert.Len(event.Hash, 64)
+		assert.Equal(i%2 == 0, event.Signature != "", "entry %d", i)
+		if i > 0 {
+			assert.Equal(events[i-1].Hash, event.PrevHash)
+		}
+	}
+	assert.Empty(events[0].PrevHash)
+
+	v, err := verifyAuditLines(keys, lines)
+	assert.Nil(err)
+	assert.Equal(5, v.Entries)
+	assert.Equal(3, v.Signatures)
+	assert.Equal(uint64(4), *v.LastSigned)
+	assert.Nil(v.CheckSigned(2))
+
+	// Entries after the last signature may not exceed the interval
+	v, err = verifyAuditLines(keys, lines[:4])
+	assert.Nil(err)
+	assert.Nil(v.CheckSigned(2))
+	assert.NotNil(v.CheckSigned(1))
+	v, err = verifyAuditLines(keys, lines[3:4])
+	assert.Nil(err)
+	assert.Nil(v.LastSigned)
+	assert.NotNil(v.CheckSigned(2))
+
+	// The chain can be verified from any entry on, e.g. after rotation
+	v, err = verifyAuditLines(keys, lines[2:])
+	assert.Nil(err)
+	assert.Equal(uint64(2), v.FirstSequence)
+
+	brokenAt := func(lines []string) (int, string) {
+		_, err := verifyAuditLines(keys, lines)
+		linkErr, ok := err.(*AuditLinkError)
+		if !assert.True(ok, "%v", err) {
+			return 0, ""
+		}
+		return linkErr.Line, linkErr.Reason
+	}
+	replace := func(i int, line string) []string {
+		changed := append([]string{}, lines...)
+		changed[i] = line
+		return changed
+	}
+	relink := func(event AuditEvent) string {
+		hash, err := auditHash(event)
+		assert.Nil(err)
+		event.Hash = hash
+		data, err := json.Marshal(event)
+		assert.Nil(err)
+		return string(data) + "\n"
+	}
+
+	// Changing an entry breaks its hash
+	line, reason := brokenAt(replace(1, strings.Replace(lines[1], `"status":201`, `"status":500`, 1)))
+	assert.Equal(2, line)
+	assert.Equal("does not match its hash", reason)
+
+	// Rehashing it breaks the link to the next entry
+	changed := events[1]
+	changed.Status = 500
+	line, reason = brokenAt(replace(1, relink(changed)))
+	assert.Equal(3, line)
+	assert.Equal("does not link to the previous entry", reason)
+
+	// Removing or reordering entries breaks the sequence
+	line, reason = brokenAt(append(append([]string{}, lines[:2]...), lines[3:]...))
+	assert.Equal(3, line)
+	assert.Equal("follows entry 1", reason)
+	line, _ = brokenAt([]string{lines[0], lines[2], lines[1]})
+	assert.Equal(2, line)
+
+	// Rewriting a signed entry requires the key
+	changed = events[4]
+	changed.Status = 500
+	line, reason = brokenAt(replace(4, relink(changed)))
+	assert.Equal(5, line)
+	assert.Equal("has an invalid signature", reason)
+
+	// Adding fields is a change too
+	line, reason = brokenAt(replace(4, strings.Replace(lines[4], "{", `{"note":"x",`, 1)))
+	assert.Equal(5, line)
+	assert.Contains(reason, "is malformed")
+
+	// Signatures are checked with the verifying keyring only
+	other, err := NewSigningKey(AlgorithmHMACSHA256)
+	assert.Nil(err)
+	_, err = verifyAuditLines(&Keyring{Keys: []*SigningKey{other}}, lines)
+	assert.NotNil(err)
+	v, err = verifyAuditLines(nil, lines)
+	assert.Nil(err)
+	assert.Equal(0, v.Signatures)
+}
+
+func TestAuditFileChain(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	keys := newTestKeyring()
+	signer := &AuditSigner{Keys: keys, Every: 3}
+	event := &AuditEvent{Method: "GET", Path: "/v1/charges", Resource: "charges", Decision: DecisionAllowed, Status: 200}
+
+	// The chain continues across rotation and restarts
+	path := filepath.Join(dir, "audit.jsonl")
+	for restart := 0; restart < 3; restart++ {
+		audit, err := OpenAuditFile(path, 1024, 10, signer)
+		assert.Nil(err)
+		for i := 0; i < 4; i++ {
+			assert.Nil(audit.Record(event))
+		}
+		assert.Nil(audit.Close())
+	}
+
+	files, err := filepath.Glob(path + ".*")
+	assert.Nil(err)
+	assert.NotEmpty(files)
+
+	v := &AuditVerifier{Keys: keys}
+	for i := len(files); i >= 0; i-- {
+		p := path
+		if i > 0 {
+			p = backupPath(path, i)
+		}
+		f, err := os.Open(p)
+		assert.Nil(err)
+		assert.Nil(v.Verify(p, f), p)
+		f.Close()
+	}
+	assert.Equal(12, v.Entries)
+	assert.Equal(uint64(0), v.FirstSequence)
+	assert.Equal(4, v.Signatures)
+	assert.Equal(uint64(9), *v.LastSigned)
+
+	// A log which can't be continued isn't appended to
+	assert.Nil(ioutil.WriteFile(path, []byte("{\n"), 0600))
+	_, err = OpenAuditFile(path, 0, 0, signer)
+	assert.NotNil(err)
+}
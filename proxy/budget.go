@@ -0,0 +1,406 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxBudgetWindow bounds the window of budgets, so that ledgers only need to
+// keep the spending of the last month.
+const MaxBudgetWindow = 31 * 24 * time.Hour
+
+// maxBudgetResponseLength bounds how much of a response is buffered to find
+// the amount which was spent.
+const maxBudgetResponseLength = 1 << 20
+
+// BudgetLedger records the amounts which credentials have spent, so that the
+// proxy can enforce their budgets.
+type BudgetLedger interface {
+	// Entries returns what the credential has spent since the time.
+	Entries(id string, since time.Time) ([]LedgerEntry, error)
+
+	// Record adds an amount which a credential has spent. An entry which
+	// could not be persisted must still be returned by Entries.
+	Record(entry LedgerEntry) error
+}
+
+// WithBudgetLedger enforces the budgets of credentials with the spending
+// recorded in the ledger. Errors while recording are passed to onError, since
+// the request has already been made.
+func WithBudgetLedger(ledger BudgetLedger, onError func(error)) Option {
+	return func(p *permissionsProxy) {
+		p.ledger = ledger
+		p.onLedgerError = onError
+	}
+}
+
+func validateBudget(budget int64, window time.Duration, currencies []string) error {
+	if budget < 0 {
+		return errors.New("The budget must not be negative")
+	}
+	if (budget == 0) != (window == 0) {
+		return errors.New("A budget requires a window, and a window a budget")
+	}
+	if budget != 0 && len(currencies) != 1 {
+		// Amounts in different currencies can't be added up
+		return errors.New("A budget requires a single currency")
+	}
+	if window < 0 || window > MaxBudgetWindow || window%time.Second != 0 {
+		return fmt.Errorf("The budget window must be whole seconds up to %s", MaxBudgetWindow)
+	}
+	return nil
+}
+
+// spendingUpdates are the routes which spend on an existing object, mapped to
+// whether they only do so when they change its amount.
+var spendingUpdates = map[string]bool{
+	"/v1/charges/{charge}/capture":         false,
+	"/v1/payment_intents/{intent}":         true,
+	"/v1/payment_intents/{intent}/capture": false,
+	"/v1/payment_intents/{intent}/confirm": false,
+}
+
+// spends reports whether the request is counted against the credential's
+// budget, which are requests that create money moving objects, change their
+// amount, or confirm or capture them.
+func spends(claims *Claims, rr resourceRoute, params url.Values) bool {
+	if claims.Budget == 0 {
+		return false
+	}
+	if _, ok := spendingResources[rr.resource]; ok && rr.access == Create {
+		return true
+	}
+	amountOnly, ok := spendingUpdates[rr.path]
+	return ok && rr.access == Update && (!amountOnly || params["amount"] != nil)
+}
+
+// budgetSpent sums the entries, counting each object once with the largest
+// amount recorded for it. The largest amount of the object which is about to
+// be spent on again is returned separately.
+func budgetSpent(entries []LedgerEntry, object string) (spent, previous int64) {
+	largest := map[string]int64{}
+	for _, entry := range entries {
+		if entry.Object == "" {
+			spent += entry.Amount
+		} else if amount, ok := largest[entry.Object]; !ok || entry.Amount > amount {
+			largest[entry.Object] = entry.Amount
+		}
+	}
+	for id, amount := range largest {
+		if id == object {
+			previous = amount
+		} else {
+			spent += amount
+		}
+	}
+	return spent, previous
+}
+
+// checkBudgetCurrency only allows spending in the currency of the credential's
+// budget. The currency of creating most objects is a parameter, which
+// checkSpendingLimits already checked, and that of refunds was looked up by
+// checkRefundCurrency, while that of existing objects is looked up here.
+func (p *permissionsProxy) checkBudgetCurrency(rr resourceRoute, req *http.Request, auth *authorization) *ErrorResponse {
+	if _, ok := spendingResources[rr.resource]; ok && rr.access == Create {
+		return nil
+	}
+
+	path, _ := objectPath(rr.path, req)
+	if path == "" {
+		return validButInsufficientError("Unable to check the currency spent from the credential's budget")
+	}
+
+	var object struct {
+		Currency string `json:"currency"`
+	}
+	if err := p.lookupObject(path, auth.stripeKey, req, &object); err != nil {
+		return validButInsufficientError(fmt.Sprintf("Unable to check the currency of %s", path))
+	}
+	if !inScope(auth.claims.Currencies, strings.ToLower(object.Currency)) {
+		return validButInsufficientError(fmt.Sprintf("Credential's budget does not allow the currency %s", object.Currency))
+	}
+	return nil
+}
+
+// keyedLocks hands out a mutex for each key. Each mutex counts the requests
+// which hold or wait for it, and is forgotten once the last of them unlocks
+// it, so that the locks don't outlive the credentials' requests.
+type keyedLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	holders int
+}
+
+func (k *keyedLocks) lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = map[string]*keyedLock{}
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.holders++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		l.holders--
+		if l.holders == 0 {
+			delete(k.locks, key)
+		}
+	}
+}
+
+// budgetResponseWriter passes the response through while keeping the start
+// of the body to read the amount from.
+type budgetResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *budgetResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *budgetResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if remaining := maxBudgetResponseLength - w.body.Len(); remaining > 0 {
+		if len(data) < remaining {
+			remaining = len(data)
+		}
+		w.body.Write(data[:remaining])
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// spentObject reads the ID and amount of the object which a request spent on.
+func spentObject(body []byte) (string, int64, error) {
+	var object struct {
+		ID     string `json:"id"`
+		Amount *int64 `json:"amount"`
+	}
+	if err := json.Unmarshal(body, &object); err != nil {
+		return "", 0, err
+	}
+	if object.Amount == nil {
+		return "", 0, errors.New("Response has no amount")
+	}
+	return object.ID, *object.Amount, nil
+}
+
+// forwardWithinBudget forwards a request which spends from the credential's
+// budget if the budget allows it, and records what was spent. The requests of
+// each credential are forwarded one at a time so that concurrent requests
+// can't overspend the budget together. Like forward, it returns how long
+// Stripe took to answer.
+func (p *permissionsProxy) forwardWithinBudget(rw http.ResponseWriter, req *http.Request, rr resourceRoute, auth *authorization) (time.Duration, *ErrorResponse) {
+	claims := auth.claims
+	if p.ledger == nil {
+		return 0, internalError("Credential has a budget but the proxy has no budget ledger")
+	}
+	if err := p.checkBudgetCurrency(rr, req, auth); err != nil {
+		return 0, err
+	}
+
+	// Updates spend on the object in their path
+	var object string
+	if rr.access == Update {
+		path, _ := objectPath(rr.path, req)
+		object = path[strings.LastIndex(path, "/")+1:]
+	}
+
+	unlock := p.budgetLocks.lock(claims.ID)
+	defer unlock()
+
+	now := time.Now()
+	entries, err := p.ledger.Entries(claims.ID, now.Add(-claims.BudgetWindow))
+	if err != nil {
+		return 0, internalError("Unable to check the credential's budget")
+	}
+	spent, previous := budgetSpent(entries, object)
+
+	// Requests which don't state an amount, e.g. refunding a whole charge or
+	// confirming a payment intent, need some budget left and are recorded
+	// with their actual amount. Such a request can take the credential over
+	// its budget, after which every request is rejected until spending
+	// leaves the window. An object which was spent on before still needs
+	// its previous amount, which the new one replaces.
+	requested, _ := strconv.ParseInt(auth.params.Get("amount"), 10, 64)
+	if requested < previous {
+		requested = previous
+	}
+	if spent >= claims.Budget || requested > claims.Budget-spent {
+		return 0, validButInsufficientError(fmt.Sprintf("Credential has %d of its budget of %d per %s left", claims.Budget-spent, claims.Budget, claims.BudgetWindow))
+	}
+
+	w := &budgetResponseWriter{ResponseWriter: rw}
+	elapsed := p.forward(w, req)
+	if w.status < 200 || w.status >= 300 {
+		return elapsed, nil
+	}
+
+	id, amount, err := spentObject(w.body.Bytes())
+	if err != nil {
+		// Count what was asked for rather than nothing
+		id, amount = object, requested
+		p.ledgerError(fmt.Errorf("Unable to read the amount spent by %s, recording %d: %s", claims.ID, amount, err))
+	}
+	if err := p.ledger.Record(LedgerEntry{ID: claims.ID, Object: id, Amount: amount, At: now}); err != nil {
+		p.ledgerError(err)
+	}
+	return elapsed, nil
+}
+
+func (p *permissionsProxy) ledgerError(err error) {
+	if p.onLedgerError != nil {
+		p.onLedgerError(err)
+	}
+}
+
+// LedgerEntry is an amount which a credential spent. Entries for the same
+// object, e.g. creating and then confirming a payment intent, only count once.
+type LedgerEntry struct {
+	ID     string    `json:"id"`
+	Object string    `json:"object,omitempty"`
+	Amount int64     `json:"amount"`
+	At     time.Time `json:"at"`
+}
+
+// LedgerFile is a BudgetLedger which appends each entry to a file of JSON
+// lines, and reads them back when it is opened so that budgets survive
+// restarts.
+type LedgerFile struct {
+	mu      sync.Mutex
+	file    *os.File
+	entries map[string][]LedgerEntry
+}
+
+// OpenLedgerFile loads the ledger from the specified file, which does not need
+// to exist yet. Entries older than MaxBudgetWindow are dropped by rewriting
+// the file before it is appended to.
+func OpenLedgerFile(path string) (*LedgerFile, error) {
+	l := &LedgerFile{entries: map[string][]LedgerEntry{}}
+
+	cutoff := time.Now().Add(-MaxBudgetWindow)
+	var kept []LedgerEntry
+	f, err := os.Open(path)
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry LedgerEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("Unable to parse ledger %s: %s", path, err)
+			}
+			if entry.At.After(cutoff) {
+				kept = append(kept, entry)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, entry := range kept {
+		enc.Encode(entry)
+		l.entries[entry.ID] = append(l.entries[entry.ID], entry)
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, err
+	}
+
+	l.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LedgerFile) Entries(id string, since time.Time) ([]LedgerEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var entries []LedgerEntry
+	for _, entry := range l.entries[id] {
+		if entry.At.After(since) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (l *LedgerFile) Record(entry LedgerEntry) error {
+	entry.At = entry.At.UTC()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Entries are recorded in order, so the expired ones are at the start
+	entries := l.entries[entry.ID]
+	cutoff := entry.At.Add(-MaxBudgetWindow)
+	for len(entries) > 0 && !entries[0].At.After(cutoff) {
+		entries = entries[1:]
+	}
+	l.entries[entry.ID] = append(entries, entry)
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Close closes the ledger file.
+func (l *LedgerFile) Close() error {
+	return l.file.Close()
+}
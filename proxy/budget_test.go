@@ -0,0 +1,260 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// amountUpstream keeps objects with the requested amount, which is 700 when
+// no amount is given, e.g. for refunding a whole charge, unless the
+// description asks for a decline. Objects are in USD unless their ID starts
+// with eur_.
+type amountUpstream struct {
+	created int
+	amounts map[string]string
+}
+
+func (u *amountUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if u.amounts == nil {
+		u.amounts = map[string]string{}
+	}
+
+	// Requests to /v1/collection/id and its actions use the object
+	segments := strings.Split(req.URL.Path, "/")
+	var id string
+	if len(segments) > 3 && segments[len(segments)-1] != "refunds" {
+		id = segments[3]
+	} else {
+		u.created++
+		id = fmt.Sprintf("obj_%d", u.created)
+	}
+
+	req.ParseForm()
+	if req.PostForm.Get("description") == "decline" {
+		rw.WriteHeader(402)
+		fmt.Fprint(rw, `{"error": {"type": "card_error"}}`)
+		return
+	}
+	if amount := req.PostForm.Get("amount"); amount != "" {
+		u.amounts[id] = amount
+	}
+	amount, ok := u.amounts[id]
+	if !ok {
+		amount = "700"
+	}
+	currency := "usd"
+	if strings.HasPrefix(id, "eur_") {
+		currency = "eur"
+	}
+	fmt.Fprintf(rw, `{"id": %q, "amount": %s, "currency": %q}`, id, amount, currency)
+}
+
+func ledgerSpent(ledger BudgetLedger, id string, since time.Time) int64 {
+	entries, _ := ledger.Entries(id, since)
+	spent, _ := budgetSpent(entries, "")
+	return spent
+}
+
+func TestBudget(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ledger")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "ledger.jsonl")
+	ledger, err := OpenLedgerFile(path)
+	assert.Nil(err)
+
+	var ledgerErrors []error
+	keys := newTestKeyring()
+	proxy := NewStripePermissionsProxy(proxyTestStripeKey, keys, &amountUpstream{}, WithBudgetLedger(ledger, func(err error) {
+		ledgerErrors = append(ledgerErrors, err)
+	}))
+
+	claims := &Claims{ID: "budgeted", Permission: NewPermission(3), Currencies: []string{"usd"}, Budget: 1000, BudgetWindow: 24 * time.Hour}
+	signed, err := Sign(claims, keys)
+	assert.Nil(err)
+
+	serve := func(credentials, path, body string) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(credentials, "")
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	// Spending from a day ago has left the window
+	assert.Nil(ledger.Record(LedgerEntry{ID: claims.ID, Amount: 10000, At: time.Now().Add(-MaxBudgetWindow - time.Hour)}))
+	assert.Nil(ledger.Record(LedgerEntry{ID: claims.ID, Amount: 1000, At: time.Now().Add(-25 * time.Hour)}))
+
+	assert.Equal(200, serve(signed, "/v1/charges", "amount=400&currency=usd"))
+	assert.Equal(200, serve(signed, "/v1/transfers", "amount=500&currency=usd"))
+	assert.Equal(402, serve(signed, "/v1/charges", "amount=100&currency=usd&description=decline"))
+	assert.Equal(403, serve(signed, "/v1/payouts", "amount=200&currency=usd"))
+
+	// Other requests don't spend from the budget
+	assert.Equal(200, serve(signed, "/v1/customers", "description=unlimited"))
+
+	// Without an amount the actual amount is recorded, so with 100 of the
+	// budget left a single request can go over it, but no further
+	assert.Equal(200, serve(signed, "/v1/refunds", "charge=ch_123"))
+	assert.Equal(int64(1600), ledgerSpent(ledger, claims.ID, time.Now().Add(-time.Hour)))
+	assert.Equal(403, serve(signed, "/v1/refunds", "charge=ch_123"))
+	assert.Empty(ledgerErrors)
+
+	// Each credential has its own budget, which survives restarts
+	other, err := Sign(&Claims{Permission: NewPermission(3), Currencies: []string{"usd"}, Budget: 1000, BudgetWindow: time.Hour}, keys)
+	assert.Nil(err)
+	assert.Equal(200, serve(other, "/v1/charges", "amount=1000&currency=usd"))
+
+	// Once nothing is left, requests without an amount are rejected too
+	assert.Equal(403, serve(other, "/v1/refunds", "charge=ch_123"))
+	assert.Equal(403, serve(other, "/v1/charges/ch_123/refunds", ""))
+
+	assert.Nil(ledger.Close())
+	reopened, err := OpenLedgerFile(path)
+	assert.Nil(err)
+	defer reopened.Close()
+	assert.Equal(int64(2600), ledgerSpent(reopened, claims.ID, time.Now().Add(-2*MaxBudgetWindow)), "entries older than any window are dropped when the ledger is opened")
+
+	// Budgets can't be enforced without a ledger
+	unledgered := NewStripePermissionsProxy(proxyTestStripeKey, keys, &amountUpstream{})
+	req := httptest.NewRequest("POST", "/v1/charges", strings.NewReader("amount=1&currency=usd"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(signed, "")
+	rw := httptest.NewRecorder()
+	unledgered.ServeHTTP(rw, req)
+	assert.Equal(500, rw.Code)
+}
+
+func TestBudgetUpdates(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ledger")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	ledger, err := OpenLedgerFile(filepath.Join(dir, "ledger.jsonl"))
+	assert.Nil(err)
+	defer ledger.Close()
+
+	keys := newTestKeyring()
+	proxy := NewStripePermissionsProxy(proxyTestStripeKey, keys, &amountUpstream{}, WithBudgetLedger(ledger, nil))
+	claims := &Claims{ID: "updating", Permission: NewPermission(3), Currencies: []string{"usd"}, Budget: 1000, BudgetWindow: time.Hour}
+	signed, err := Sign(claims, keys)
+	assert.Nil(err)
+
+	serve := func(path, body string) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(signed, "")
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	// Changing the amount and confirming spend on the same payment intent
+	assert.Equal(200, serve("/v1/payment_intents/pi_123", "amount=900"))
+	assert.Equal(200, serve("/v1/payment_intents/pi_123/confirm", ""))
+	assert.Equal(200, serve("/v1/payment_intents/pi_123", "description=unchanged"))
+	assert.Equal(int64(900), ledgerSpent(ledger, claims.ID, time.Now().Add(-time.Hour)))
+	assert.Equal(403, serve("/v1/payment_intents/pi_123", "amount=1100"))
+	assert.Equal(403, serve("/v1/payment_intents/pi_456", "amount=200"))
+
+	// Capturing counts the actual amount once there is budget left
+	assert.Equal(200, serve("/v1/charges/ch_123/capture", ""))
+	assert.Equal(int64(1600), ledgerSpent(ledger, claims.ID, time.Now().Add(-time.Hour)))
+	assert.Equal(403, serve("/v1/payment_intents/pi_456/capture", ""))
+
+	// Other currencies are rejected, including those which are looked up
+	other, err := Sign(&Claims{ID: "euros", Permission: NewPermission(3), Currencies: []string{"usd"}, Budget: 1000, BudgetWindow: time.Hour}, keys)
+	assert.Nil(err)
+	signed = other
+	assert.Equal(403, serve("/v1/charges", "amount=100&currency=eur"))
+	assert.Equal(403, serve("/v1/payment_intents/eur_pi/confirm", ""))
+	assert.Equal(403, serve("/v1/refunds", "charge=eur_ch&amount=100"))
+	assert.Equal(403, serve("/v1/refunds", "payment_intent=eur_pi"))
+	assert.Equal(403, serve("/v1/charges/eur_ch/refunds", ""))
+	assert.Equal(403, serve("/v1/refunds", "amount=100"))
+	assert.Equal(int64(0), ledgerSpent(ledger, "euros", time.Now().Add(-time.Hour)))
+	assert.Equal(200, serve("/v1/charges/ch_123/refunds", "amount=100"))
+}
+
+func TestKeyedLocks(t *testing.T) {
+	assert := assert.New(t)
+
+	var locks keyedLocks
+	unlock := locks.lock("a")
+	locked := make(chan struct{})
+	go func() {
+		locks.lock("a")()
+		close(locked)
+	}()
+
+	// Other keys aren't held up
+	locks.lock("b")()
+	select {
+	case <-locked:
+		assert.Fail("The lock was taken twice")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Locks are forgotten once nobody holds or waits for them
+	unlock()
+	<-locked
+	assert.Empty(locks.locks)
+}
+
+func TestBudgetClaims(t *testing.T) {
+	assert := assert.New(t)
+
+	budgeted := &Claims{Permission: NewPermission(3), Currencies: []string{"usd"}, Budget: 500000, BudgetWindow: 24 * time.Hour}
+	encoded, err := encodeClaims(budgeted)
+	assert.Nil(err)
+	decoded, err := decodeClaims(encoded)
+	assert.Nil(err)
+	assert.Equal(budgeted.Budget, decoded.Budget)
+	assert.Equal(budgeted.BudgetWindow, decoded.BudgetWindow)
+
+	for _, invalid := range []*Claims{
+		{Permission: NewPermission(3), Currencies: []string{"usd"}, Budget: 500},
+		{Permission: NewPermission(3), Currencies: []string{"usd"}, BudgetWindow: time.Hour},
+		{Permission: NewPermission(3), Currencies: []string{"usd"}, Budget: -1, BudgetWindow: time.Hour},
+		{Permission: NewPermission(3), Currencies: []string{"usd"}, Budget: 500, BudgetWindow: time.Millisecond},
+		{Permission: NewPermission(3), Currencies: []string{"usd"}, Budget: 500, BudgetWindow: 2 * MaxBudgetWindow},
+		{Permission: NewPermission(3), Budget: 500, BudgetWindow: time.Hour},
+		{Permission: NewPermission(3), Currencies: []string{"usd", "eur"}, Budget: 500, BudgetWindow: time.Hour},
+	} {
+		_, err := encodeClaims(invalid)
+		assert.NotNil(err)
+	}
+
+	// A budget without its window isn't accepted either
+	_, err = decodeClaims([]byte{envelopeV1, fieldPermission, 8, 0, 0, 0, 0, 0, 0, 0, 3, fieldBudget, 8, 0, 0, 0, 0, 0, 0, 1, 0})
+	assert.NotNil(err)
+}
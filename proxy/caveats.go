@@ -0,0 +1,220 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Caveat further restricts a credential, in the style of macaroons. Anyone
+// holding a credential can append a caveat to derive a narrower credential
+// without the signing key, and the caveat can't be removed again.
+//
+// Each caveat is chained into the MAC: the signature of a credential with
+// caveats is HMAC(...HMAC(HMAC(key, claims), caveat1)..., caveatN). Because
+// the holder only knows the final MAC, they can append caveats but never
+// compute the MAC of the credential without them.
+type Caveat struct {
+	// Permission limits the resources and access which are granted, if nil
+	// the permission is not restricted.
+	Permission *Permission
+
+	// NotBefore and Expires narrow the validity window, zero times do not
+	// restrict it.
+	NotBefore time.Time
+	Expires   time.Time
+
+	// Customers narrows the customer scope, if nil the scope is not
+	// restricted.
+	Customers []string
+
+	// Accounts narrows the connected accounts, if nil they are not
+	// restricted.
+	Accounts []string
+
+	// MaxAmount and Currencies narrow the spending limits, zero and nil do
+	// not restrict them.
+	MaxAmount  int64
+	Currencies []string
+}
+
+func encodeCaveat(c *Caveat) ([]byte, error) {
+	if c.Customers != nil && len(c.Customers) == 0 {
+		return nil, errors.New("Caveat must list at least one customer to scope to")
+	}
+	if c.Accounts != nil && len(c.Accounts) == 0 {
+		return nil, errors.New("Caveat must list at least one account to bind to")
+	}
+	if err := validateLimits(c.MaxAmount, c.Currencies); err != nil {
+		return nil, err
+	}
+
+	w := newEnvelopeWriter(envelopeV1)
+	if c.Permission != nil {
+		w.writePermission(c.Permission)
+	}
+	w.writeTime(fieldNotBefore, c.NotBefore)
+	w.writeTime(fieldExpires, c.Expires)
+	w.writeStrings(fieldCustomers, c.Customers)
+	w.writeStrings(fieldAccounts, c.Accounts)
+	w.writeAmount(fieldMaxAmount, c.MaxAmount)
+	w.writeStrings(fieldCurrencies, c.Currencies)
+
+	if len(w.bytes()) == 1 {
+		return nil, errors.New("Caveat does not restrict anything")
+	}
+	return w.bytes(), nil
+}
+
+func decodeCaveat(data []byte) (*Caveat, error) {
+	if len(data) == 0 {
+		return nil, errTruncated
+	}
+	if data[0] != envelopeV1 {
+		return nil, fmt.Errorf("Unsupported caveat format version %d", data[0]&^formatFlag)
+	}
+
+	c := &Caveat{}
+	seen := map[byte]bool{}
+	var operations []byte
+
+	r := &envelopeReader{data[1:]}
+	for r.more() {
+		tag, value, err := r.readField()
+		if err != nil {
+			return nil, err
+		}
+
+		if seen[tag] {
+			return nil, fmt.Errorf("Duplicate caveat field %d", tag)
+		}
+		seen[tag] = true
+
+		switch tag {
+		case fieldPermission:
+			p := &Permission{}
+			if err := p.UnmarshalBinary(value); err != nil {
+				return nil, err
+			}
+			c.Permission = p
+		case fieldOperations:
+			operations = value
+		case fieldNotBefore:
+			c.NotBefore, err = decodeFieldTime(value)
+		case fieldExpires:
+			c.Expires, err = decodeFieldTime(value)
+		case fieldCustomers:
+			c.Customers, err = decodeFieldStrings(value)
+		case fieldAccounts:
+			c.Accounts, err = decodeFieldStrings(value)
+		case fieldMaxAmount:
+			c.MaxAmount, err = decodeFieldAmount(value)
+		case fieldCurrencies:
+			c.Currencies, err = decodeFieldStrings(value)
+		default:
+			return nil, fmt.Errorf("Unsupported caveat field %d", tag)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := decodeOperations(c.Permission, operations); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// restrict narrows the claims to what is also allowed by the caveat.
+func (c *Claims) restrict(caveat *Caveat) {
+	if caveat.Permission != nil {
+		c.Permission = c.Permission.Intersect(caveat.Permission)
+	}
+	if !caveat.NotBefore.IsZero() && caveat.NotBefore.After(c.NotBefore) {
+		c.NotBefore = caveat.NotBefore
+	}
+	if !caveat.Expires.IsZero() && (c.Expires.IsZero() || caveat.Expires.Before(c.Expires)) {
+		c.Expires = caveat.Expires
+	}
+	if caveat.Customers != nil {
+		c.Customers = restrictScope(c.Customers, caveat.Customers)
+	}
+	if caveat.Accounts != nil {
+		c.Accounts = restrictScope(c.Accounts, caveat.Accounts)
+	}
+	if caveat.MaxAmount != 0 && (c.MaxAmount == 0 || caveat.MaxAmount < c.MaxAmount) {
+		c.MaxAmount = caveat.MaxAmount
+	}
+	if caveat.Currencies != nil {
+		c.Currencies = restrictScope(c.Currencies, caveat.Currencies)
+	}
+	c.Caveats = append(c.Caveats, caveat)
+}
+
+func (c *Claims) applyCaveats(caveats [][]byte) error {
+	for _, caveatBytes := range caveats {
+		caveat, err := decodeCaveat(caveatBytes)
+		if err != nil {
+			return err
+		}
+		c.restrict(caveat)
+	}
+	return nil
+}
+
+// chainMac computes the MAC of claims followed by the caveats.
+func chainMac(key, claimsBytes []byte, caveats [][]byte) []byte {
+	mac := computeMac(key, claimsBytes)
+	for _, caveat := range caveats {
+		mac = computeMac(mac, caveat)
+	}
+	return mac
+}
+
+// Attenuate derives a credential which is restricted by the caveat in
+// addition to everything that already restricts the credential. Only
+// credentials signed with HMAC keys can be attenuated.
+func Attenuate(credentials string, caveat *Caveat) (string, error) {
+	claimsBytes, caveats, mac, err := splitCredentials(credentials)
+	if err != nil {
+		return "", err
+	}
+
+	c, err := decodeClaims(claimsBytes)
+	if err != nil {
+		return "", err
+	}
+	if c.Algorithm != AlgorithmHMACSHA256 {
+		return "", errors.New("Only credentials signed with HMAC keys can be attenuated")
+	}
+
+	caveatBytes, err := encodeCaveat(caveat)
+	if err != nil {
+		return "", err
+	}
+
+	parts := []string{base64.RawStdEncoding.EncodeToString(claimsBytes)}
+	for _, existing := range caveats {
+		parts = append(parts, base64.RawStdEncoding.EncodeToString(existing))
+	}
+	parts = append(parts, base64.RawStdEncoding.EncodeToString(caveatBytes))
+	parts = append(parts, base64.RawStdEncoding.EncodeToString(computeMac(mac, caveatBytes)))
+
+	return strings.Join(parts, separator), nil
+}
@@ -0,0 +1,158 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttenuatedPermission(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Permission{}
+	p.SetAccess(ReadWrite, ResourceCustomers)
+	p.SetAccess(Read, ResourceCharges)
+
+	keys := newTestKeyring()
+	parent, err := Sign(&Claims{Permission: p}, keys)
+	assert.Nil(err)
+
+	// Ask for more than the parent has, the derived credential only gets the
+	// overlap.
+	narrower := &Permission{}
+	narrower.SetAccess(Read, ResourceCustomers, ResourceTransfers)
+	narrower.SetAccess(Write, ResourceCharges)
+
+	child, err := Attenuate(parent, &Caveat{Permission: narrower})
+	assert.Nil(err)
+
+	c, err := Verify(child, keys)
+	assert.Nil(err)
+	assert.Len(c.Caveats, 1)
+	assert.True(c.Permission.Can(Read, ResourceCustomers))
+	assert.False(c.Permission.Can(Write, ResourceCustomers))
+	assert.False(c.Permission.Can(Read, ResourceTransfers))
+	assert.False(c.Permission.Can(Write, ResourceCharges))
+	assert.False(c.Permission.Can(Read, ResourceCharges))
+
+	// The parent ID is kept so that revoking the parent revokes the child
+	parentClaims, err := Verify(parent, keys)
+	assert.Nil(err)
+	assert.Equal(parentClaims.ID, c.ID)
+}
+
+func TestAttenuatedResourceAll(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Permission{}
+	p.SetAccess(Read, ResourceAll)
+
+	keys := newTestKeyring()
+	parent, err := Sign(&Claims{Permission: p}, keys)
+	assert.Nil(err)
+
+	narrower := &Permission{}
+	narrower.SetAccess(ReadWrite, ResourceEvents)
+
+	child, err := Attenuate(parent, &Caveat{Permission: narrower})
+	assert.Nil(err)
+
+	c, err := Verify(child, keys)
+	assert.Nil(err)
+	assert.True(c.Permission.Can(Read, ResourceEvents))
+	assert.False(c.Permission.Can(Write, ResourceEvents))
+	assert.False(c.Permission.Can(Read, ResourceAll))
+	assert.False(c.Permission.Can(Read, ResourceCustomers))
+}
+
+func TestAttenuatedExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Permission{}
+	p.SetAccess(Read, ResourceAll)
+
+	keys := newTestKeyring()
+	expires := time.Now().Add(time.Hour)
+	parent, err := Sign(&Claims{Permission: p, Expires: expires}, keys)
+	assert.Nil(err)
+
+	// A later expiry can't extend the parent
+	later, err := Attenuate(parent, &Caveat{Expires: expires.Add(time.Hour)})
+	assert.Nil(err)
+	c, err := Verify(later, keys)
+	assert.Nil(err)
+	assert.Equal(expires.Unix(), c.Expires.Unix())
+
+	// An earlier expiry shortens it, even when chained after a later one
+	expired, err := Attenuate(later, &Caveat{Expires: time.Now().Add(-time.Minute)})
+	assert.Nil(err)
+	_, err = Verify(expired, keys)
+	assert.NotNil(err)
+}
+
+func TestCaveatsCannotBeRemoved(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Permission{}
+	p.SetAccess(ReadWrite, ResourceAll)
+
+	keys := newTestKeyring()
+	parent, err := Sign(&Claims{Permission: p}, keys)
+	assert.Nil(err)
+
+	narrower := &Permission{}
+	narrower.SetAccess(Read, ResourceEvents)
+	child, err := Attenuate(parent, &Caveat{Permission: narrower})
+	assert.Nil(err)
+
+	// Dropping the caveat while keeping the derived MAC fails
+	parts := strings.Split(child, separator)
+	stripped := strings.Join([]string{parts[0], parts[2]}, separator)
+	_, err = Verify(stripped, keys)
+	assert.NotNil(err)
+
+	// Swapping in a broader caveat fails
+	broader, err := Attenuate(parent, &Caveat{Permission: p})
+	assert.Nil(err)
+	broaderParts := strings.Split(broader, separator)
+	swapped := strings.Join([]string{parts[0], broaderParts[1], parts[2]}, separator)
+	_, err = Verify(swapped, keys)
+	assert.NotNil(err)
+
+	// Empty caveats are refused
+	_, err = Attenuate(parent, &Caveat{})
+	assert.NotNil(err)
+}
+
+func TestEd25519CannotBeAttenuated(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Permission{}
+	p.SetAccess(Read, ResourceAll)
+
+	key, err := NewSigningKey(AlgorithmEd25519)
+	assert.Nil(err)
+	keys := &Keyring{Keys: []*SigningKey{key}}
+
+	signed, err := Sign(&Claims{Permission: p}, keys)
+	assert.Nil(err)
+
+	_, err = Attenuate(signed, &Caveat{Expires: time.Now().Add(time.Hour)})
+	assert.NotNil(err)
+}
@@ -16,61 +16,236 @@ package proxy
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"strings"
+	"time"
 )
 
 const separator = "_"
 
+// Claims are the signed contents of a credential. A zero time means that the
+// corresponding bound is not enforced, which is also how credentials issued
+// before timestamps were introduced are decoded.
+type Claims struct {
+	// ID uniquely identifies the credential so that it can be revoked. Sign
+	// generates one if it is empty.
+	ID string
+
+	Permission *Permission
+	IssuedAt   time.Time
+	NotBefore  time.Time
+	Expires    time.Time
+
+	// Customers restricts the credential to the objects of these customers,
+	// see checkCustomerScope. A nil scope is unrestricted, while an empty
+	// scope, which caveats can narrow a scope down to, allows no customers.
+	Customers []string
+
+	// Accounts binds the credential to these connected accounts, see
+	// checkAccountScope. Like Customers, nil is unbound while an empty list
+	// allows no accounts.
+	Accounts []string
+
+	// MaxAmount limits the amount of each charge, refund, transfer, payout
+	// and payment intent in the currency's smallest unit, and Currencies the
+	// lowercase ISO codes they may use, see checkSpendingLimits. Zero and nil
+	// are unlimited.
+	MaxAmount  int64
+	Currencies []string
+
+	// Budget limits the total amount which the credential, and anything
+	// attenuated from it, may spend within each BudgetWindow, see
+	// forwardWithinBudget. Zero is unlimited.
+	Budget       int64
+	BudgetWindow time.Duration
+
+	// RateLimit and MaxInFlight limit the requests of the credential, and
+	// anything attenuated from it, on top of the proxy's own limits. Zero
+	// values are unlimited.
+	RateLimit   Rate
+	MaxInFlight int64
+
+	// Mode selects the Stripe key which the proxy uses for the credential,
+	// so that test credentials never reach live data.
+	Mode Mode
+
+	// Upstream names the Stripe account which the credential targets, if
+	// the proxy serves several, see WithUpstreams.
+	Upstream string
+
+	// KeyID identifies the key which signed the credential and Algorithm is
+	// how it was signed, both are filled in by Sign.
+	KeyID     string
+	Algorithm KeyAlgorithm
+
+	// Caveats are the restrictions which were appended to the credential
+	// after it was signed. Verify has already applied them to the claims.
+	Caveats []*Caveat
+}
+
+func (c *Claims) MarshalBinary() ([]byte, error) {
+	return encodeClaims(c)
+}
+
+func (c *Claims) UnmarshalBinary(data []byte) error {
+	decoded, err := decodeClaims(data)
+	if err != nil {
+		return err
+	}
+	*c = *decoded
+	return nil
+}
+
+// Valid reports whether the claims are usable at the specified time.
+func (c *Claims) Valid(at time.Time) error {
+	if !c.NotBefore.IsZero() && at.Before(c.NotBefore) {
+		return errors.New("Credential is not valid yet")
+	}
+	if !c.Expires.IsZero() && !at.Before(c.Expires) {
+		return errors.New("Credential has expired")
+	}
+	return nil
+}
+
 func computeMac(key, message []byte) []byte {
 	mac := hmac.New(sha256.New, key)
 	mac.Write(message)
 	return mac.Sum(nil)
 }
 
-func Sign(p *Permission, stripeKey []byte) (string, error) {
-	permissionBytes, err := p.MarshalBinary()
+// NewCredentialID generates a random ID for a credential.
+func NewCredentialID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func Sign(c *Claims, keys *Keyring) (string, error) {
+	key, err := keys.SigningKey()
 	if err != nil {
 		return "", err
 	}
 
-	mac := computeMac(stripeKey, permissionBytes)
+	withKey := *c
+	if withKey.ID == "" {
+		withKey.ID, err = NewCredentialID()
+		if err != nil {
+			return "", err
+		}
+	}
+	withKey.KeyID = key.ID
+	withKey.Algorithm = key.Algorithm
+	claimsBytes, err := withKey.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
 
-	permissionEncoded := base64.RawStdEncoding.EncodeToString(permissionBytes)
+	mac, err := key.sign(claimsBytes)
+	if err != nil {
+		return "", err
+	}
+
+	permissionEncoded := base64.RawStdEncoding.EncodeToString(claimsBytes)
 	macEncoded := base64.RawStdEncoding.EncodeToString(mac)
 	permissionAndMac := []string{permissionEncoded, macEncoded}
 
 	return strings.Join(permissionAndMac, separator), nil
 }
 
-func Verify(credentials string, stripeKey []byte) (*Permission, error) {
-	permissionAndMac := strings.SplitN(credentials, separator, 2)
+// splitCredentials decodes the parts of a credential, which are the claims,
+// any caveats and finally the MAC or signature.
+func splitCredentials(credentials string) ([]byte, [][]byte, []byte, error) {
+	parts := strings.Split(credentials, separator)
+
+	if len(parts) < 2 {
+		return nil, nil, nil, errors.New("Invalid signed permissions")
+	}
 
-	if len(permissionAndMac) != 2 {
-		return nil, errors.New("Invalid signed permissions")
+	decoded := make([][]byte, len(parts))
+	for i, part := range parts {
+		bs, err := base64.RawStdEncoding.DecodeString(part)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		decoded[i] = bs
 	}
 
-	permissionBytes, err := base64.RawStdEncoding.DecodeString(permissionAndMac[0])
+	last := len(decoded) - 1
+	return decoded[0], decoded[1:last], decoded[last], nil
+}
+
+func Verify(credentials string, keys *Keyring) (*Claims, error) {
+	claimsBytes, caveats, expectedMac, err := splitCredentials(credentials)
 	if err != nil {
 		return nil, err
 	}
-	expectedMac, err := base64.RawStdEncoding.DecodeString(permissionAndMac[1])
+
+	// The claims are not trusted until the MAC has been checked, they are
+	// only decoded first to find out which key to check it with.
+	c := Claims{}
+	err = c.UnmarshalBinary(claimsBytes)
 	if err != nil {
 		return nil, err
 	}
 
-	computed := computeMac(stripeKey, permissionBytes)
-	if !hmac.Equal(computed, expectedMac) {
-		return nil, errors.New("MAC signature was not verified")
+	key, ok := keys.Lookup(c.KeyID)
+	if !ok {
+		return nil, errors.New("Credential was signed with an unknown key")
+	}
+
+	// The algorithm is dictated by the key, never by the credential, so that
+	// a public key can't be used as an HMAC secret.
+	if c.Algorithm != key.Algorithm {
+		return nil, errors.New("Credential was signed with the wrong algorithm for its key")
+	}
+
+	if len(caveats) == 0 {
+		if !key.verify(claimsBytes, expectedMac) {
+			return nil, errors.New("MAC signature was not verified")
+		}
+	} else {
+		if key.Algorithm != AlgorithmHMACSHA256 {
+			return nil, errors.New("Only credentials signed with HMAC keys can have caveats")
+		}
+		if !hmac.Equal(chainMac(key.Secret, claimsBytes, caveats), expectedMac) {
+			return nil, errors.New("MAC signature was not verified")
+		}
+	}
+
+	if err := c.applyCaveats(caveats); err != nil {
+		return nil, err
+	}
+
+	if err := c.Valid(time.Now()); err != nil {
+		return nil, err
 	}
 
-	p := Permission{}
-	err = p.BinaryUnmarshaler(permissionBytes)
+	return &c, nil
+}
+
+// Decode reads the claims of a credential and applies its caveats without
+// checking the signature or validity window, so the result must not be used
+// to authorize anything.
+func Decode(credentials string) (*Claims, error) {
+	claimsBytes, caveats, _, err := splitCredentials(credentials)
 	if err != nil {
 		return nil, err
 	}
 
-	return &p, nil
+	c := Claims{}
+	if err := c.UnmarshalBinary(claimsBytes); err != nil {
+		return nil, err
+	}
+
+	if err := c.applyCaveats(caveats); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
 }
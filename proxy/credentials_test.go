@@ -15,7 +15,10 @@
 package proxy
 
 import (
+	"encoding/base64"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -29,18 +32,18 @@ func TestGoodCredential(t *testing.T) {
 	p.SetAccess(Read, ResourceCustomers, ResourceCharges, ResourceDisputes, ResourceEvents)
 	p.SetAccess(Write, ResourceEvents)
 
-	assert.NotZero(p.encoded)
+	assert.NotEmpty(p.Grants())
 
-	key := []byte(keyString)
-	signed, err := Sign(p, key)
+	key := newTestKeyring()
+	signed, err := Sign(&Claims{Permission: p}, key)
 	assert.Nil(err)
 	assert.NotZero(signed)
 
 	q, err := Verify(signed, key)
 	assert.Nil(err)
-	assert.Equal(q, p)
+	assert.Equal(q.Permission, p)
 
-	assert.True(q.Can(Write, ResourceEvents))
+	assert.True(q.Permission.Can(Write, ResourceEvents))
 }
 
 func TestBadCredential(t *testing.T) {
@@ -50,10 +53,10 @@ func TestBadCredential(t *testing.T) {
 	p.SetAccess(Read, ResourceCustomers, ResourceCharges, ResourceDisputes, ResourceEvents)
 	p.SetAccess(Write, ResourceEvents)
 
-	assert.NotZero(p.encoded)
+	assert.NotEmpty(p.Grants())
 
-	key := []byte(keyString)
-	signed, err := Sign(p, key)
+	key := newTestKeyring()
+	signed, err := Sign(&Claims{Permission: p}, key)
 	assert.Nil(err)
 	assert.NotZero(signed)
 
@@ -63,3 +66,100 @@ func TestBadCredential(t *testing.T) {
 	assert.Nil(q)
 	assert.NotNil(err)
 }
+
+func TestLegacyCredential(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Permission{}
+	p.SetAccess(Read, ResourceCustomers)
+
+	// Credentials issued before claims existed sign the bare permission
+	permissionBytes, err := p.MarshalBinary()
+	assert.Nil(err)
+
+	mac := computeMac([]byte(keyString), permissionBytes)
+	signed := base64.RawStdEncoding.EncodeToString(permissionBytes) + separator + base64.RawStdEncoding.EncodeToString(mac)
+
+	// They only verify when the legacy key is in the keyring
+	q, err := Verify(signed, newTestKeyring())
+	assert.Nil(q)
+	assert.NotNil(err)
+
+	q, err = Verify(signed, newTestKeyring().WithLegacyKey(keyString))
+	assert.Nil(err)
+	assert.Equal(p, q.Permission)
+	assert.True(q.Expires.IsZero())
+}
+
+func TestCredentialValidityWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Permission{}
+	p.SetAccess(Read, ResourceCustomers)
+
+	key := newTestKeyring()
+	now := time.Now()
+
+	var windowTests = []struct {
+		notBefore time.Time
+		expires   time.Time
+		valid     bool
+	}{
+		{time.Time{}, time.Time{}, true},
+		{now.Add(-time.Hour), now.Add(time.Hour), true},
+		{time.Time{}, now.Add(-time.Minute), false},
+		{now.Add(time.Hour), time.Time{}, false},
+	}
+
+	for _, tt := range windowTests {
+		c := &Claims{
+			Permission: p,
+			IssuedAt:   now,
+			NotBefore:  tt.notBefore,
+			Expires:    tt.expires,
+		}
+		signed, err := Sign(c, key)
+		assert.Nil(err)
+
+		q, err := Verify(signed, key)
+		if tt.valid {
+			assert.Nil(err)
+			assert.Equal(now.Unix(), q.IssuedAt.Unix())
+			assert.Equal(tt.expires.Unix(), q.Expires.Unix())
+		} else {
+			assert.Nil(q)
+			assert.NotNil(err)
+		}
+	}
+}
+
+func TestDecodeUnverified(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Permission{}
+	p.SetAccess(ReadWrite, ResourceCustomers)
+
+	signed, err := Sign(&Claims{Permission: p}, newTestKeyring())
+	assert.Nil(err)
+
+	narrower := &Permission{}
+	narrower.SetAccess(Read, ResourceCustomers)
+	attenuated, err := Attenuate(signed, &Caveat{Permission: narrower})
+	assert.Nil(err)
+
+	// Decoding needs no key and applies the caveats
+	c, err := Decode(attenuated)
+	assert.Nil(err)
+	assert.Equal("testkey", c.KeyID)
+	assert.Len(c.Caveats, 1)
+	assert.Equal("customers:read", c.Permission.String())
+
+	// Even when the signature is broken
+	parts := strings.Split(signed, separator)
+	c, err = Decode(parts[0] + separator + "AAAA")
+	assert.Nil(err)
+	assert.Equal("customers:rw", c.Permission.String())
+
+	_, err = Decode("garbage")
+	assert.NotNil(err)
+}
@@ -0,0 +1,427 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Versioned credential payloads start with a format byte which has the high
+// bit set, followed by a sequence of fields. Each field is a one byte tag, a
+// uvarint length and the value itself.
+//
+// Payloads from before the envelope was introduced start with the most
+// significant byte of the permission vector, which never had the high bit set
+// because no resource above ResourceRadarRule existed at the time.
+const (
+	formatFlag byte = 0x80
+	envelopeV1 byte = formatFlag | 1
+)
+
+// Note: these do not use iota so that they are stable through modifications
+// of the list.
+const (
+	fieldPermission   byte = 1
+	fieldIssuedAt     byte = 2
+	fieldNotBefore    byte = 3
+	fieldExpires      byte = 4
+	fieldKeyID        byte = 5
+	fieldAlgorithm    byte = 6
+	fieldID           byte = 7
+	fieldOperations   byte = 8
+	fieldCustomers    byte = 9
+	fieldAccounts     byte = 10
+	fieldMaxAmount    byte = 11
+	fieldCurrencies   byte = 12
+	fieldBudget       byte = 13
+	fieldBudgetWindow byte = 14
+	fieldRateLimit    byte = 15
+	fieldMaxInFlight  byte = 16
+	fieldMode         byte = 17
+	fieldUpstream     byte = 18
+)
+
+// Credentials signed with HMAC keys omit the algorithm field.
+const (
+	algorithmEd25519 byte = 1
+)
+
+const (
+	timeLength       = 8
+	amountLength     = 8
+	permissionLength = 8
+)
+
+var errTruncated = errors.New("Credential payload is truncated")
+
+type envelopeWriter struct {
+	buf []byte
+}
+
+func newEnvelopeWriter(version byte) *envelopeWriter {
+	return &envelopeWriter{buf: []byte{version}}
+}
+
+func (w *envelopeWriter) writeField(tag byte, value []byte) {
+	var length [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(length[:], uint64(len(value)))
+
+	w.buf = append(w.buf, tag)
+	w.buf = append(w.buf, length[:n]...)
+	w.buf = append(w.buf, value...)
+}
+
+func (w *envelopeWriter) writeTime(tag byte, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	bs := make([]byte, timeLength)
+	binary.BigEndian.PutUint64(bs, uint64(t.Unix()))
+	w.writeField(tag, bs)
+}
+
+func (w *envelopeWriter) writeAmount(tag byte, amount int64) {
+	if amount == 0 {
+		return
+	}
+	bs := make([]byte, amountLength)
+	binary.BigEndian.PutUint64(bs, uint64(amount))
+	w.writeField(tag, bs)
+}
+
+// writeRate writes the requests and the seconds of the period.
+func (w *envelopeWriter) writeRate(tag byte, r Rate) {
+	if r == (Rate{}) {
+		return
+	}
+	bs := make([]byte, 2*amountLength)
+	binary.BigEndian.PutUint64(bs, uint64(r.Requests))
+	binary.BigEndian.PutUint64(bs[amountLength:], uint64(r.Per/time.Second))
+	w.writeField(tag, bs)
+}
+
+// writeStrings writes a list of strings, each prefixed with its uvarint
+// length. Empty lists are omitted.
+func (w *envelopeWriter) writeStrings(tag byte, values []string) {
+	if len(values) == 0 {
+		return
+	}
+
+	var buf []byte
+	var length [binary.MaxVarintLen64]byte
+	for _, value := range values {
+		n := binary.PutUvarint(length[:], uint64(len(value)))
+		buf = append(buf, length[:n]...)
+		buf = append(buf, value...)
+	}
+	w.writeField(tag, buf)
+}
+
+// writePermission writes the read and write groups of the permission, along
+// with the individual operations if the groups don't describe it.
+func (w *envelopeWriter) writePermission(p *Permission) {
+	w.writeField(fieldPermission, p.marshalGroups())
+	if operations := p.marshalOperations(); operations != nil {
+		w.writeField(fieldOperations, operations)
+	}
+}
+
+func (w *envelopeWriter) bytes() []byte {
+	return w.buf
+}
+
+type envelopeReader struct {
+	data []byte
+}
+
+func (r *envelopeReader) more() bool {
+	return len(r.data) > 0
+}
+
+func (r *envelopeReader) readField() (byte, []byte, error) {
+	if len(r.data) < 2 {
+		return 0, nil, errTruncated
+	}
+
+	tag := r.data[0]
+	length, n := binary.Uvarint(r.data[1:])
+	if n <= 0 {
+		return 0, nil, errTruncated
+	}
+
+	rest := r.data[1+n:]
+	if length > uint64(len(rest)) {
+		return 0, nil, errTruncated
+	}
+
+	value := rest[:length]
+	r.data = rest[length:]
+	return tag, value, nil
+}
+
+func decodeFieldTime(value []byte) (time.Time, error) {
+	if len(value) != timeLength {
+		return time.Time{}, errors.New("Invalid credential timestamp length")
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(value)), 0), nil
+}
+
+func decodeFieldAmount(value []byte) (int64, error) {
+	if len(value) != amountLength {
+		return 0, errors.New("Invalid credential amount length")
+	}
+	amount := int64(binary.BigEndian.Uint64(value))
+	if amount <= 0 {
+		return 0, errors.New("Invalid credential amount")
+	}
+	return amount, nil
+}
+
+func decodeFieldRate(value []byte) (Rate, error) {
+	if len(value) != 2*amountLength {
+		return Rate{}, errors.New("Invalid credential rate length")
+	}
+	requests, err := decodeFieldAmount(value[:amountLength])
+	if err != nil {
+		return Rate{}, err
+	}
+	seconds, err := decodeFieldAmount(value[amountLength:])
+	if err != nil {
+		return Rate{}, err
+	}
+	r := Rate{requests, time.Duration(seconds) * time.Second}
+	return r, r.validate()
+}
+
+func decodeFieldMode(value []byte) (Mode, error) {
+	if len(value) == 1 {
+		for mode, b := range modeBytes {
+			if value[0] == b {
+				return mode, nil
+			}
+		}
+	}
+	return ModeDefault, errors.New("Invalid credential mode")
+}
+
+func decodeFieldStrings(value []byte) ([]string, error) {
+	var values []string
+	for len(value) > 0 {
+		length, n := binary.Uvarint(value)
+		if n <= 0 || length == 0 || length > uint64(len(value)-n) {
+			return nil, errors.New("Invalid credential string list")
+		}
+		values = append(values, string(value[n:n+int(length)]))
+		value = value[n+int(length):]
+	}
+	if len(values) == 0 {
+		return nil, errors.New("Invalid credential string list")
+	}
+	return values, nil
+}
+
+func encodeClaims(c *Claims) ([]byte, error) {
+	if c.Permission == nil {
+		return nil, errors.New("Claims must include a permission")
+	}
+	if c.Customers != nil && len(c.Customers) == 0 {
+		// An empty list would be encoded as no restriction at all
+		return nil, errors.New("Claims must list at least one customer to scope to")
+	}
+	if c.Accounts != nil && len(c.Accounts) == 0 {
+		return nil, errors.New("Claims must list at least one account to bind to")
+	}
+	if err := validateLimits(c.MaxAmount, c.Currencies); err != nil {
+		return nil, err
+	}
+	if err := validateBudget(c.Budget, c.BudgetWindow, c.Currencies); err != nil {
+		return nil, err
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		return nil, err
+	}
+	if c.MaxInFlight < 0 {
+		return nil, errors.New("The maximum number of requests in flight must not be negative")
+	}
+
+	w := newEnvelopeWriter(envelopeV1)
+	w.writePermission(c.Permission)
+	if c.ID != "" {
+		w.writeField(fieldID, []byte(c.ID))
+	}
+	w.writeTime(fieldIssuedAt, c.IssuedAt)
+	w.writeTime(fieldNotBefore, c.NotBefore)
+	w.writeTime(fieldExpires, c.Expires)
+	w.writeStrings(fieldCustomers, c.Customers)
+	w.writeStrings(fieldAccounts, c.Accounts)
+	w.writeAmount(fieldMaxAmount, c.MaxAmount)
+	w.writeStrings(fieldCurrencies, c.Currencies)
+	w.writeAmount(fieldBudget, c.Budget)
+	w.writeAmount(fieldBudgetWindow, int64(c.BudgetWindow/time.Second))
+	w.writeRate(fieldRateLimit, c.RateLimit)
+	w.writeAmount(fieldMaxInFlight, c.MaxInFlight)
+	if c.Mode != ModeDefault {
+		mode, ok := modeBytes[c.Mode]
+		if !ok {
+			return nil, fmt.Errorf("Unknown mode %q", c.Mode)
+		}
+		w.writeField(fieldMode, []byte{mode})
+	}
+	if c.Upstream != "" {
+		w.writeField(fieldUpstream, []byte(c.Upstream))
+	}
+	if c.KeyID != LegacyKeyID {
+		w.writeField(fieldKeyID, []byte(c.KeyID))
+	}
+	switch c.Algorithm {
+	case AlgorithmHMACSHA256, "":
+	case AlgorithmEd25519:
+		w.writeField(fieldAlgorithm, []byte{algorithmEd25519})
+	default:
+		return nil, fmt.Errorf("Unsupported key algorithm %s", c.Algorithm)
+	}
+	return w.bytes(), nil
+}
+
+func decodeClaims(data []byte) (*Claims, error) {
+	if len(data) == 0 {
+		return nil, errTruncated
+	}
+
+	if data[0]&formatFlag == 0 {
+		return decodeLegacyClaims(data)
+	}
+
+	switch data[0] {
+	case envelopeV1:
+		return decodeEnvelopeV1(data[1:])
+	default:
+		return nil, fmt.Errorf("Unsupported credential format version %d", data[0]&^formatFlag)
+	}
+}
+
+// decodeOperations adds the individual operations to the permission which
+// was decoded from the same envelope.
+func decodeOperations(p *Permission, operations []byte) error {
+	if operations == nil {
+		return nil
+	}
+	if p == nil {
+		return errors.New("Permission operations without a permission")
+	}
+	return p.unmarshalOperations(operations)
+}
+
+func decodeEnvelopeV1(data []byte) (*Claims, error) {
+	c := &Claims{Algorithm: AlgorithmHMACSHA256}
+	seen := map[byte]bool{}
+	var operations []byte
+
+	r := &envelopeReader{data}
+	for r.more() {
+		tag, value, err := r.readField()
+		if err != nil {
+			return nil, err
+		}
+
+		if seen[tag] {
+			return nil, fmt.Errorf("Duplicate credential field %d", tag)
+		}
+		seen[tag] = true
+
+		switch tag {
+		case fieldPermission:
+			p := &Permission{}
+			if err := p.UnmarshalBinary(value); err != nil {
+				return nil, err
+			}
+			c.Permission = p
+		case fieldOperations:
+			operations = value
+		case fieldIssuedAt:
+			c.IssuedAt, err = decodeFieldTime(value)
+		case fieldNotBefore:
+			c.NotBefore, err = decodeFieldTime(value)
+		case fieldExpires:
+			c.Expires, err = decodeFieldTime(value)
+		case fieldCustomers:
+			c.Customers, err = decodeFieldStrings(value)
+		case fieldAccounts:
+			c.Accounts, err = decodeFieldStrings(value)
+		case fieldMaxAmount:
+			c.MaxAmount, err = decodeFieldAmount(value)
+		case fieldCurrencies:
+			c.Currencies, err = decodeFieldStrings(value)
+		case fieldBudget:
+			c.Budget, err = decodeFieldAmount(value)
+		case fieldBudgetWindow:
+			var seconds int64
+			seconds, err = decodeFieldAmount(value)
+			c.BudgetWindow = time.Duration(seconds) * time.Second
+		case fieldRateLimit:
+			c.RateLimit, err = decodeFieldRate(value)
+		case fieldMaxInFlight:
+			c.MaxInFlight, err = decodeFieldAmount(value)
+		case fieldMode:
+			c.Mode, err = decodeFieldMode(value)
+		case fieldUpstream:
+			c.Upstream = string(value)
+		case fieldKeyID:
+			c.KeyID = string(value)
+		case fieldID:
+			c.ID = string(value)
+		case fieldAlgorithm:
+			if len(value) != 1 || value[0] != algorithmEd25519 {
+				return nil, errors.New("Unsupported credential algorithm")
+			}
+			c.Algorithm = AlgorithmEd25519
+		default:
+			// Unknown fields may restrict the credential in ways that we
+			// can't enforce, so they must not be ignored.
+			return nil, fmt.Errorf("Unsupported credential field %d", tag)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Permission == nil {
+		return nil, errors.New("Credential is missing a permission")
+	}
+	if err := decodeOperations(c.Permission, operations); err != nil {
+		return nil, err
+	}
+	if err := validateBudget(c.Budget, c.BudgetWindow, c.Currencies); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// decodeLegacyClaims handles payloads which are the bare permission vector.
+func decodeLegacyClaims(data []byte) (*Claims, error) {
+	if len(data) != permissionLength {
+		return nil, errors.New("Invalid credential length")
+	}
+
+	p := &Permission{}
+	if err := p.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return &Claims{Permission: p, Algorithm: AlgorithmHMACSHA256}, nil
+}
@@ -0,0 +1,186 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Permission{}
+	p.SetAccess(ReadWrite, ResourceCharges)
+	c := &Claims{
+		ID:         "0123456789abcdef",
+		Permission: p,
+		IssuedAt:   time.Unix(1500000000, 0),
+		Expires:    time.Unix(1600000000, 0),
+		KeyID:      "testkey",
+		Algorithm:  AlgorithmEd25519,
+	}
+
+	encoded, err := encodeClaims(c)
+	assert.Nil(err)
+	assert.Equal(envelopeV1, encoded[0])
+
+	decoded, err := decodeClaims(encoded)
+	assert.Nil(err)
+	assert.Equal(c, decoded)
+	assert.True(decoded.NotBefore.IsZero())
+}
+
+func TestEnvelopeOperations(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Permission{}
+	p.SetAccess(Read, ResourceCustomers)
+	p.SetAccess(Create, ResourceRefunds)
+	encoded, err := encodeClaims(&Claims{Permission: p})
+	assert.Nil(err)
+
+	// The groups are a subset of the permission, so a decoder which only
+	// understood them could never grant more than was signed
+	groups := &Permission{}
+	groups.SetAccess(Read, ResourceCustomers)
+	assert.Equal(append([]byte{envelopeV1, fieldPermission, 8}, groups.marshalGroups()...), encoded[:11])
+	assert.Equal(fieldOperations, encoded[11])
+
+	decoded, err := decodeClaims(encoded)
+	assert.Nil(err)
+	assert.Equal(p, decoded.Permission)
+	assert.True(decoded.Permission.Can(Create, ResourceRefunds))
+	assert.False(decoded.Permission.Can(Delete, ResourceRefunds))
+
+	// Permissions of whole groups don't need the operations field
+	encoded, err = encodeClaims(&Claims{Permission: groups})
+	assert.Nil(err)
+	assert.Len(encoded, 11)
+}
+
+func TestEnvelopeScopes(t *testing.T) {
+	assert := assert.New(t)
+
+	scoped := &Claims{
+		Permission:  NewPermission(3),
+		Customers:   []string{"cus_123", "cus_456"},
+		Accounts:    []string{"acct_123"},
+		MaxAmount:   5000,
+		Currencies:  []string{"usd"},
+		RateLimit:   Rate{10, time.Minute},
+		MaxInFlight: 4,
+		Mode:        ModeTest,
+		Upstream:    "eu",
+	}
+	encoded, err := encodeClaims(scoped)
+	assert.Nil(err)
+	decoded, err := decodeClaims(encoded)
+	assert.Nil(err)
+	assert.Equal(scoped.Customers, decoded.Customers)
+	assert.Equal(scoped.Accounts, decoded.Accounts)
+	assert.Equal(scoped.MaxAmount, decoded.MaxAmount)
+	assert.Equal(scoped.Currencies, decoded.Currencies)
+	assert.Equal(scoped.RateLimit, decoded.RateLimit)
+	assert.Equal(scoped.MaxInFlight, decoded.MaxInFlight)
+	assert.Equal(scoped.Mode, decoded.Mode)
+	assert.Equal(scoped.Upstream, decoded.Upstream)
+
+	// An empty scope can't be told apart from no scope once encoded
+	_, err = encodeClaims(&Claims{Permission: NewPermission(3), Customers: []string{}})
+	assert.NotNil(err)
+	_, err = encodeCaveat(&Caveat{Customers: []string{}})
+	assert.NotNil(err)
+	_, err = encodeClaims(&Claims{Permission: NewPermission(3), Accounts: []string{}})
+	assert.NotNil(err)
+
+	for _, invalid := range [][]byte{
+		{envelopeV1, fieldPermission, 8, 0, 0, 0, 0, 0, 0, 0, 3, fieldCustomers, 0},
+		{envelopeV1, fieldPermission, 8, 0, 0, 0, 0, 0, 0, 0, 3, fieldCustomers, 1, 0},
+		{envelopeV1, fieldPermission, 8, 0, 0, 0, 0, 0, 0, 0, 3, fieldCustomers, 2, 5, 'c'},
+		{envelopeV1, fieldPermission, 8, 0, 0, 0, 0, 0, 0, 0, 3, fieldAccounts, 0},
+		{envelopeV1, fieldPermission, 8, 0, 0, 0, 0, 0, 0, 0, 3, fieldMaxAmount, 1, 1},
+		{envelopeV1, fieldPermission, 8, 0, 0, 0, 0, 0, 0, 0, 3, fieldRateLimit, 8, 0, 0, 0, 0, 0, 0, 0, 1},
+		{envelopeV1, fieldPermission, 8, 0, 0, 0, 0, 0, 0, 0, 3, fieldMode, 1, 3},
+		{envelopeV1, fieldPermission, 8, 0, 0, 0, 0, 0, 0, 0, 3, fieldMaxAmount, 8, 0, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		_, err := decodeClaims(invalid)
+		assert.NotNil(err, "%v should not decode", invalid)
+	}
+}
+
+func TestLegacyPayloads(t *testing.T) {
+	assert := assert.New(t)
+
+	bare := []byte{0, 0, 0, 0, 0, 0, 0, 64}
+	c, err := decodeClaims(bare)
+	assert.Nil(err)
+	assert.True(c.Permission.Can(Read, ResourceCustomers))
+	assert.True(c.Expires.IsZero())
+
+	// Times were never appended to released legacy payloads
+	withTimes := make([]byte, permissionLength+3*timeLength)
+	copy(withTimes, bare)
+	withTimes[len(withTimes)-1] = 1
+	_, err = decodeClaims(withTimes)
+	assert.NotNil(err)
+}
+
+func TestMalformedPayloads(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Permission{}
+	p.SetAccess(Read, ResourceAll)
+	encoded, err := encodeClaims(&Claims{Permission: p, Expires: time.Now()})
+	assert.Nil(err)
+
+	// Truncations which cut into a field must be rejected without panicking,
+	// the MAC is what protects against dropping whole fields.
+	permissionEnd := 1 + 2 + permissionLength
+	for i := 0; i < len(encoded); i++ {
+		_, err := decodeClaims(encoded[:i])
+		if i != permissionEnd {
+			assert.NotNil(err, "truncation to %d bytes should fail", i)
+		}
+	}
+
+	var malformedTests = [][]byte{
+		// Unknown format version
+		{formatFlag | 0x7f, fieldPermission, 8, 0, 0, 0, 0, 0, 0, 0, 1},
+		// Missing permission
+		{envelopeV1},
+		// Unknown field
+		{envelopeV1, fieldPermission, 8, 0, 0, 0, 0, 0, 0, 0, 1, 0x7f, 0},
+		// Duplicate field
+		{envelopeV1, fieldPermission, 8, 0, 0, 0, 0, 0, 0, 0, 1, fieldPermission, 8, 0, 0, 0, 0, 0, 0, 0, 3},
+		// Wrong permission length
+		{envelopeV1, fieldPermission, 2, 0, 1},
+		// Operations without a permission
+		{envelopeV1, fieldOperations, 1, 1},
+		// Unknown operation
+		{envelopeV1, fieldPermission, 8, 0, 0, 0, 0, 0, 0, 0, 0, fieldOperations, 1, 0x20},
+		// Length overflowing the payload
+		{envelopeV1, fieldPermission, 0xff, 0xff, 0xff, 0xff, 0x0f},
+		// Legacy payload with an odd length
+		{0, 0, 0, 1},
+	}
+
+	for _, tt := range malformedTests {
+		_, err := decodeClaims(tt)
+		assert.NotNil(err, "%v should be rejected", tt)
+	}
+}
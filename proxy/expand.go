@@ -0,0 +1,125 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// expandResources maps the expandable fields of Stripe objects to the
+// resource which they expand into. Stripe names these fields consistently
+// across objects, so the field name is enough to find the resource.
+// Expanding a field which isn't listed requires access to all resources.
+var expandResources = map[string]StripeResource{
+	"account":                ResourceAccount,
+	"application_fee":        ResourceApplicationFee,
+	"authorization":          ResourceIssuingAuthorization,
+	"balance_transaction":    ResourceBalance,
+	"card":                   ResourceIssuingCard,
+	"cardholder":             ResourceIssuingCardholder,
+	"charge":                 ResourceCharges,
+	"coupon":                 ResourceCoupon,
+	"credit_note":            ResourceCreditNote,
+	"customer":               ResourceCustomers,
+	"default_payment_method": ResourcePaymentMethod,
+	"default_source":         ResourceSource,
+	"default_tax_rates":      ResourceTaxRate,
+	"destination":            ResourceAccount,
+	"destination_payment":    ResourceCharges,
+	"dispute":                ResourceDisputes,
+	"file":                   ResourceFileUploads,
+	"invoice":                ResourceInvoice,
+	"invoiceitem":            ResourceInvoiceItem,
+	"latest_charge":          ResourceCharges,
+	"latest_invoice":         ResourceInvoice,
+	"location":               ResourceTerminalLocation,
+	"on_behalf_of":           ResourceAccount,
+	"payment_intent":         ResourcePaymentIntent,
+	"payment_method":         ResourcePaymentMethod,
+	"pending_setup_intent":   ResourceSetupIntent,
+	"plan":                   ResourcePlan,
+	"price":                  ResourcePrice,
+	"product":                ResourceProduct,
+	"refund":                 ResourceRefunds,
+	"refunds":                ResourceRefunds,
+	"review":                 ResourceRadarReview,
+	"setup_intent":           ResourceSetupIntent,
+	"source_refund":          ResourceRefunds,
+	"source_transaction":     ResourceCharges,
+	"source_transfer":        ResourceTransfers,
+	"subscription":           ResourceSubscription,
+	"tax_rates":              ResourceTaxRate,
+	"transfer":               ResourceTransfers,
+	"transfer_reversal":      ResourceTransferReversals,
+}
+
+// objectExpandResources overrides expandResources for fields whose resource
+// depends on the object they belong to, e.g. the destination of a payout is
+// an external account rather than a connected account.
+var objectExpandResources = map[StripeResource]map[string]StripeResource{
+	ResourcePayout: {"destination": ResourceExternalAccount},
+}
+
+// transparentFields are lists of the parent object's own items, such as the
+// data of a list response, which don't expand into another resource.
+var transparentFields = map[string]bool{
+	"data":       true,
+	"line_items": true,
+	"lines":      true,
+}
+
+var expandParamPattern = regexp.MustCompile(`^expand(\[\d*\])?$`)
+
+// expandedResources lists the resource of every field along an expand path,
+// e.g. data.invoice.subscription requires both invoices and subscriptions.
+// The first field belongs to an object of the route's resource, and each
+// further field to the object expanded before it.
+func expandedResources(owner StripeResource, expand string) []StripeResource {
+	var resources []StripeResource
+	for _, field := range strings.Split(expand, ".") {
+		if transparentFields[field] {
+			continue
+		}
+		resource, ok := objectExpandResources[owner][field]
+		if !ok {
+			resource, ok = expandResources[field]
+		}
+		if !ok {
+			resource = ResourceAll
+		}
+		resources = append(resources, resource)
+		owner = resource
+	}
+	return resources
+}
+
+// expandParams finds the expand parameters in any of the expand, expand[]
+// and expand[N] forms.
+func expandParams(params url.Values) []string {
+	var expands []string
+	for key, values := range params {
+		if !expandParamPattern.MatchString(key) {
+			continue
+		}
+		for _, v := range values {
+			if v != "" {
+				expands = append(expands, v)
+			}
+		}
+	}
+	return expands
+}
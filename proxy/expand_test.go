@@ -0,0 +1,48 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/url"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandedResources(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([]StripeResource{ResourceCustomers}, expandedResources(ResourceCharges, "customer"))
+	assert.Equal([]StripeResource{ResourceInvoice, ResourceSubscription}, expandedResources(ResourceSubscription, "data.invoice.subscription"))
+	assert.Equal([]StripeResource{ResourcePaymentIntent, ResourceAll}, expandedResources(ResourceCharges, "payment_intent.unknown_field"))
+	assert.Nil(expandedResources(ResourceInvoice, "lines.data"))
+
+	// The destination of a payout is an external account, while that of a
+	// transfer is a connected account
+	assert.Equal([]StripeResource{ResourceExternalAccount}, expandedResources(ResourcePayout, "data.destination"))
+	assert.Equal([]StripeResource{ResourceAccount}, expandedResources(ResourceTransfers, "destination"))
+	assert.Equal([]StripeResource{ResourceTransfers, ResourceAccount}, expandedResources(ResourceCharges, "transfer.destination"))
+}
+
+func TestExpandParamForms(t *testing.T) {
+	assert := assert.New(t)
+
+	params, err := url.ParseQuery("expand[]=customer&expand[0]=invoice&expand=review&expanded=x&expand[]=&expand[a]=charge")
+	assert.Nil(err)
+	expands := expandParams(params)
+	sort.Strings(expands)
+	assert.Equal([]string{"customer", "invoice", "review"}, expands)
+}
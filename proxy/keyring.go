@@ -0,0 +1,417 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const minSecretLength = 32
+
+// KeyAlgorithm is the scheme which a key signs credentials with.
+type KeyAlgorithm string
+
+const (
+	// AlgorithmHMACSHA256 keys are shared secrets, anyone who can verify
+	// credentials with them can also sign new credentials.
+	AlgorithmHMACSHA256 KeyAlgorithm = "hmac-sha256"
+
+	// AlgorithmEd25519 keys sign with a private key which can be kept
+	// offline, while the proxy only holds the public key.
+	AlgorithmEd25519 KeyAlgorithm = "ed25519"
+)
+
+// LegacyKeyID identifies the key which verifies credentials that were signed
+// before key IDs were embedded in them. Those were signed with the Stripe
+// secret key itself.
+const LegacyKeyID = ""
+
+// SigningKey is a secret which credentials are signed and verified with.
+// Keys which have been rotated out are marked verify-only so that the
+// credentials they signed keep working until the key is retired.
+//
+// For Ed25519 keys the Secret is the private key, which is omitted from the
+// keyring that the proxy is run with.
+type SigningKey struct {
+	ID         string       `json:"id"`
+	Algorithm  KeyAlgorithm `json:"algorithm,omitempty"`
+	Secret     []byte       `json:"secret,omitempty"`
+	PublicKey  []byte       `json:"public_key,omitempty"`
+	Created    time.Time    `json:"created"`
+	VerifyOnly bool         `json:"verify_only,omitempty"`
+}
+
+// Keyring holds every key that the proxy will verify credentials with, in the
+// order they were added. The newest key which is not verify-only is used for
+// signing new credentials.
+type Keyring struct {
+	Keys []*SigningKey `json:"keys"`
+}
+
+// KeyringSource provides the keyring to use for each request, which allows
+// the keys to change while the proxy is running.
+type KeyringSource interface {
+	Keyring() *Keyring
+}
+
+// NewSigningKey generates a random key with a random ID.
+func NewSigningKey(algorithm KeyAlgorithm) (*SigningKey, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	key := &SigningKey{
+		ID:        hex.EncodeToString(id),
+		Algorithm: algorithm,
+		Created:   time.Now().UTC(),
+	}
+
+	switch algorithm {
+	case AlgorithmHMACSHA256:
+		key.Secret = make([]byte, minSecretLength)
+		if _, err := rand.Read(key.Secret); err != nil {
+			return nil, err
+		}
+	case AlgorithmEd25519:
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key.Secret = private
+		key.PublicKey = public
+	default:
+		return nil, fmt.Errorf("Unsupported key algorithm %s", algorithm)
+	}
+
+	return key, nil
+}
+
+// validate checks that the key material matches the algorithm.
+func (key *SigningKey) validate() error {
+	switch key.Algorithm {
+	case AlgorithmHMACSHA256:
+		if len(key.Secret) < minSecretLength {
+			return fmt.Errorf("Key %s must be at least %d bytes", key.ID, minSecretLength)
+		}
+	case AlgorithmEd25519:
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("Key %s must have a %d byte public key", key.ID, ed25519.PublicKeySize)
+		}
+		if len(key.Secret) == 0 {
+			return nil
+		}
+		if len(key.Secret) != ed25519.PrivateKeySize {
+			return fmt.Errorf("Key %s must have a %d byte private key", key.ID, ed25519.PrivateKeySize)
+		}
+		derived := ed25519.PrivateKey(key.Secret).Public().(ed25519.PublicKey)
+		if !bytes.Equal(derived, key.PublicKey) {
+			return fmt.Errorf("Key %s has a private key which does not match its public key", key.ID)
+		}
+	default:
+		return fmt.Errorf("Key %s has unsupported algorithm %s", key.ID, key.Algorithm)
+	}
+	return nil
+}
+
+// canSign reports whether the key holds the material needed to sign.
+func (key *SigningKey) canSign() bool {
+	return key.ID != LegacyKeyID && !key.VerifyOnly && len(key.Secret) > 0
+}
+
+func (key *SigningKey) sign(message []byte) ([]byte, error) {
+	switch key.Algorithm {
+	case AlgorithmHMACSHA256:
+		return computeMac(key.Secret, message), nil
+	case AlgorithmEd25519:
+		return ed25519.Sign(ed25519.PrivateKey(key.Secret), message), nil
+	default:
+		return nil, fmt.Errorf("Unsupported key algorithm %s", key.Algorithm)
+	}
+}
+
+func (key *SigningKey) verify(message, signature []byte) bool {
+	switch key.Algorithm {
+	case AlgorithmHMACSHA256:
+		return hmac.Equal(computeMac(key.Secret, message), signature)
+	case AlgorithmEd25519:
+		return len(signature) == ed25519.SignatureSize && ed25519.Verify(ed25519.PublicKey(key.PublicKey), message, signature)
+	default:
+		return false
+	}
+}
+
+// ParseKeyring decodes and validates a JSON encoded keyring.
+func ParseKeyring(data []byte) (*Keyring, error) {
+	k := &Keyring{}
+	if err := json.Unmarshal(data, k); err != nil {
+		return nil, err
+	}
+
+	if len(k.Keys) == 0 {
+		return nil, errors.New("Keyring does not contain any keys")
+	}
+
+	seen := map[string]bool{}
+	for _, key := range k.Keys {
+		if key.ID == LegacyKeyID {
+			return nil, errors.New("Keyring keys must have an ID")
+		}
+		if seen[key.ID] {
+			return nil, fmt.Errorf("Keyring contains duplicate key ID %s", key.ID)
+		}
+		seen[key.ID] = true
+
+		// Keyrings from before algorithms were introduced only held HMAC
+		// keys.
+		if key.Algorithm == "" {
+			key.Algorithm = AlgorithmHMACSHA256
+		}
+		if err := key.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return k, nil
+}
+
+// LoadKeyring reads a JSON encoded keyring from the specified file.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(data)
+}
+
+// Save writes the keyring to the specified file, readable only by the owner.
+// The file is replaced atomically so that a running proxy never reads a
+// partially written keyring.
+func (k *Keyring) Save(path string) error {
+	data, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Keyring implements KeyringSource for a keyring which never changes.
+func (k *Keyring) Keyring() *Keyring {
+	return k
+}
+
+// WithLegacyKey returns a copy of the keyring which also verifies credentials
+// that were signed with the Stripe secret key before key IDs were introduced.
+func (k *Keyring) WithLegacyKey(stripeKey string) *Keyring {
+	keys := []*SigningKey{{
+		ID:         LegacyKeyID,
+		Algorithm:  AlgorithmHMACSHA256,
+		Secret:     []byte(stripeKey),
+		VerifyOnly: true,
+	}}
+	return &Keyring{Keys: append(keys, k.Keys...)}
+}
+
+// Lookup finds the key with the specified ID.
+func (k *Keyring) Lookup(id string) (*SigningKey, bool) {
+	for _, key := range k.Keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// SigningKey returns the key which new credentials should be signed with.
+func (k *Keyring) SigningKey() (*SigningKey, error) {
+	for i := len(k.Keys) - 1; i >= 0; i-- {
+		if key := k.Keys[i]; key.canSign() {
+			return key, nil
+		}
+	}
+	return nil, errors.New("Keyring does not contain a signing key")
+}
+
+// Public returns a copy of the keyring which only contains the public halves
+// of its Ed25519 keys. It can verify, but never sign, credentials.
+func (k *Keyring) Public() (*Keyring, error) {
+	public := &Keyring{}
+	for _, key := range k.Keys {
+		if key.Algorithm != AlgorithmEd25519 {
+			continue
+		}
+		publicKey := *key
+		publicKey.Secret = nil
+		public.Keys = append(public.Keys, &publicKey)
+	}
+
+	if len(public.Keys) == 0 {
+		return nil, errors.New("Keyring does not contain any Ed25519 keys")
+	}
+	return public, nil
+}
+
+// public reports whether the keyring only holds the public halves of Ed25519
+// keys.
+func (k *Keyring) public() bool {
+	for _, key := range k.Keys {
+		if key.Algorithm != AlgorithmEd25519 || len(key.Secret) > 0 {
+			return false
+		}
+	}
+	return len(k.Keys) > 0
+}
+
+// CheckVerifyOnly returns an error if the keyring holds the private half of
+// an Ed25519 key, which isn't needed to verify credentials.
+func (k *Keyring) CheckVerifyOnly() error {
+	for _, key := range k.Keys {
+		if key.Algorithm == AlgorithmEd25519 && len(key.Secret) > 0 {
+			return fmt.Errorf("Keyring holds the private key of %s, use the keyring from keys public instead", key.ID)
+		}
+	}
+	return nil
+}
+
+// Rotate adds a new signing key and marks every existing key as verify-only.
+// Without an algorithm, the new key uses that of the current signing key, so
+// that e.g. an Ed25519 keyring keeps working as a public keyring. A public
+// keyring has no signing key, and must be rotated from the private keyring
+// instead of growing a secret of its own.
+func (k *Keyring) Rotate(algorithm KeyAlgorithm) (*SigningKey, error) {
+	if algorithm == "" {
+		current, err := k.SigningKey()
+		if err == nil {
+			algorithm = current.Algorithm
+		} else if k.public() {
+			return nil, errors.New("Keyring only holds public keys, rotate the private keyring and run keys public instead")
+		} else {
+			algorithm = AlgorithmHMACSHA256
+		}
+	}
+
+	key, err := NewSigningKey(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, existing := range k.Keys {
+		existing.VerifyOnly = true
+	}
+	k.Keys = append(k.Keys, key)
+	return key, nil
+}
+
+// Retire removes a verify-only key, after which the credentials that it signed
+// are no longer accepted.
+func (k *Keyring) Retire(id string) error {
+	for i, key := range k.Keys {
+		if key.ID != id {
+			continue
+		}
+		if !key.VerifyOnly {
+			return fmt.Errorf("Key %s is still used for signing, rotate it first", id)
+		}
+		k.Keys = append(k.Keys[:i], k.Keys[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("Keyring does not contain key %s", id)
+}
+
+// KeyringFile is a KeyringSource which reloads the keyring when the file it
+// was loaded from changes.
+type KeyringFile struct {
+	file *watchedFile
+}
+
+// NewKeyringFile loads the keyring from the specified file.
+func NewKeyringFile(path string) (*KeyringFile, error) {
+	return newKeyringFile(path, LoadKeyring)
+}
+
+// NewVerifyingKeyringFile loads the keyring from the specified file like
+// NewKeyringFile, but rejects keyrings which hold Ed25519 private keys, so
+// that the proxy can't be made to sign credentials by reloading one.
+func NewVerifyingKeyringFile(path string) (*KeyringFile, error) {
+	return newKeyringFile(path, func(path string) (*Keyring, error) {
+		k, err := LoadKeyring(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := k.CheckVerifyOnly(); err != nil {
+			return nil, err
+		}
+		return k, nil
+	})
+}
+
+func newKeyringFile(path string, loadKeyring func(string) (*Keyring, error)) (*KeyringFile, error) {
+	load := func(path string) (interface{}, error) {
+		return loadKeyring(path)
+	}
+
+	f := &KeyringFile{&watchedFile{path: path, load: load}}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *KeyringFile) Keyring() *Keyring {
+	return f.file.get().(*Keyring)
+}
+
+// Reload reads the keyring file if it has changed since it was last loaded.
+// If the new contents are invalid the previous keyring stays in use.
+func (f *KeyringFile) Reload() error {
+	return f.file.reload()
+}
+
+// Watch checks the keyring file for changes at the specified interval until
+// the returned function is called. Errors while reloading are passed to
+// onError.
+func (f *KeyringFile) Watch(interval time.Duration, onError func(error)) func() {
+	return f.file.watch(interval, onError)
+}
+
+type legacyKeyringSource struct {
+	source    KeyringSource
+	stripeKey string
+}
+
+func (l *legacyKeyringSource) Keyring() *Keyring {
+	return l.source.Keyring().WithLegacyKey(l.stripeKey)
+}
+
+// WithLegacyKeySource wraps a KeyringSource so that its keyrings also verify
+// credentials that were signed with the Stripe secret key.
+func WithLegacyKeySource(source KeyringSource, stripeKey string) KeyringSource {
+	return &legacyKeyringSource{source, stripeKey}
+}
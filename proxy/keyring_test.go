@@ -0,0 +1,303 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSigningSecret = "thisisatestsigningsecretthatislongenough"
+
+func newTestKeyring() *Keyring {
+	return &Keyring{Keys: []*SigningKey{
+		{ID: "testkey", Algorithm: AlgorithmHMACSHA256, Secret: []byte(testSigningSecret)},
+	}}
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "keyring")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	key, err := NewSigningKey(AlgorithmHMACSHA256)
+	assert.Nil(err)
+
+	path := filepath.Join(dir, "keyring.json")
+	k := &Keyring{Keys: []*SigningKey{key}}
+	assert.Nil(k.Save(path))
+
+	loaded, err := LoadKeyring(path)
+	assert.Nil(err)
+	assert.Equal(k, loaded)
+
+	signingKey, err := loaded.SigningKey()
+	assert.Nil(err)
+	assert.Equal(key.ID, signingKey.ID)
+}
+
+func TestInvalidKeyrings(t *testing.T) {
+	assert := assert.New(t)
+
+	var invalidTests = []string{
+		`{}`,
+		`{"keys": []}`,
+		`{"keys": [{"id": "", "secret": "dGhpc2lzYXRlc3RzaWduaW5nc2VjcmV0dGhhdGlzbG9uZ2Vub3VnaA=="}]}`,
+		`{"keys": [{"id": "short", "secret": "c2hvcnQ="}]}`,
+		`{"keys": [{"id": "a", "secret": "dGhpc2lzYXRlc3RzaWduaW5nc2VjcmV0dGhhdGlzbG9uZ2Vub3VnaA=="}, {"id": "a", "secret": "dGhpc2lzYXRlc3RzaWduaW5nc2VjcmV0dGhhdGlzbG9uZ2Vub3VnaA=="}]}`,
+	}
+
+	for _, tt := range invalidTests {
+		_, err := ParseKeyring([]byte(tt))
+		assert.NotNil(err, "%s should be rejected", tt)
+	}
+}
+
+func TestCredentialKeySelection(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Permission{}
+	p.SetAccess(Read, ResourceAll)
+
+	old := newTestKeyring()
+	signed, err := Sign(&Claims{Permission: p}, old)
+	assert.Nil(err)
+
+	newKey, err := NewSigningKey(AlgorithmHMACSHA256)
+	assert.Nil(err)
+
+	// A keyring without the signing key can't verify the credential
+	other := &Keyring{Keys: []*SigningKey{newKey}}
+	_, err = Verify(signed, other)
+	assert.NotNil(err)
+
+	// A keyring with both keys finds the right one by ID
+	both := &Keyring{Keys: append(old.Keys, newKey)}
+	c, err := Verify(signed, both)
+	assert.Nil(err)
+	assert.Equal("testkey", c.KeyID)
+
+	// The legacy key is never used for signing
+	legacyOnly := (&Keyring{}).WithLegacyKey(keyString)
+	_, err = Sign(&Claims{Permission: p}, legacyOnly)
+	assert.NotNil(err)
+}
+
+func TestKeyringRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Permission{}
+	p.SetAccess(Read, ResourceAll)
+
+	k := newTestKeyring()
+	oldSigned, err := Sign(&Claims{Permission: p}, k)
+	assert.Nil(err)
+
+	newKey, err := k.Rotate(AlgorithmHMACSHA256)
+	assert.Nil(err)
+	assert.True(k.Keys[0].VerifyOnly)
+
+	signingKey, err := k.SigningKey()
+	assert.Nil(err)
+	assert.Equal(newKey, signingKey)
+
+	newSigned, err := Sign(&Claims{Permission: p}, k)
+	assert.Nil(err)
+
+	// Both the old and new credentials are accepted after rotating
+	c, err := Verify(oldSigned, k)
+	assert.Nil(err)
+	assert.Equal("testkey", c.KeyID)
+	c, err = Verify(newSigned, k)
+	assert.Nil(err)
+	assert.Equal(newKey.ID, c.KeyID)
+
+	// The signing key can't be retired
+	assert.NotNil(k.Retire(newKey.ID))
+	assert.NotNil(k.Retire("missing"))
+
+	// Retiring the old key rejects the old credentials
+	assert.Nil(k.Retire("testkey"))
+	_, err = Verify(oldSigned, k)
+	assert.NotNil(err)
+	_, err = Verify(newSigned, k)
+	assert.Nil(err)
+
+	// Without an algorithm the signing key's is kept
+	ed, err := NewSigningKey(AlgorithmEd25519)
+	assert.Nil(err)
+	k = &Keyring{Keys: []*SigningKey{ed}}
+	rotated, err := k.Rotate("")
+	assert.Nil(err)
+	assert.Equal(AlgorithmEd25519, rotated.Algorithm)
+	public, err := k.Public()
+	assert.Nil(err)
+	assert.Len(public.Keys, 2)
+	edSigned, err := Sign(&Claims{Permission: p}, k)
+	assert.Nil(err)
+	_, err = Verify(edSigned, public)
+	assert.Nil(err)
+
+	// A public keyring can't be rotated into one which signs
+	_, err = public.Rotate("")
+	assert.NotNil(err)
+	assert.Len(public.Keys, 2)
+	_, err = public.SigningKey()
+	assert.NotNil(err)
+
+	rotated, err = newTestKeyring().Rotate("")
+	assert.Nil(err)
+	assert.Equal(AlgorithmHMACSHA256, rotated.Algorithm)
+}
+
+func TestKeyringFileReload(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "keyring")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keyring.json")
+	key, err := NewSigningKey(AlgorithmHMACSHA256)
+	assert.Nil(err)
+	k := &Keyring{Keys: []*SigningKey{key}}
+	assert.Nil(k.Save(path))
+
+	f, err := NewKeyringFile(path)
+	assert.Nil(err)
+	assert.Equal(k, f.Keyring())
+
+	newKey, err := k.Rotate(AlgorithmHMACSHA256)
+	assert.Nil(err)
+	assert.Nil(k.Save(path))
+	assert.Nil(os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+
+	assert.Nil(f.Reload())
+	_, ok := f.Keyring().Lookup(newKey.ID)
+	assert.True(ok)
+
+	// An invalid file leaves the previous keyring in place
+	assert.Nil(ioutil.WriteFile(path, []byte("{"), 0600))
+	assert.Nil(os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second)))
+	assert.NotNil(f.Reload())
+	_, ok = f.Keyring().Lookup(newKey.ID)
+	assert.True(ok)
+}
+
+func TestVerifyingKeyringFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "keyring")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	key, err := NewSigningKey(AlgorithmEd25519)
+	assert.Nil(err)
+	private := &Keyring{Keys: []*SigningKey{key}}
+	public, err := private.Public()
+	assert.Nil(err)
+	assert.Nil(public.CheckVerifyOnly())
+	assert.Nil(newTestKeyring().CheckVerifyOnly())
+
+	path := filepath.Join(dir, "keyring.json")
+	assert.Nil(private.Save(path))
+	_, err = NewVerifyingKeyringFile(path)
+	assert.NotNil(err)
+
+	assert.Nil(public.Save(path))
+	f, err := NewVerifyingKeyringFile(path)
+	assert.Nil(err)
+	assert.Equal(public, f.Keyring())
+
+	// Reloading a private keyring leaves the public one in place
+	_, err = private.Rotate("")
+	assert.Nil(err)
+	assert.Nil(private.Save(path))
+	assert.Nil(os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	assert.NotNil(f.Reload())
+	assert.Equal(public, f.Keyring())
+}
+
+func TestEd25519Credentials(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Permission{}
+	p.SetAccess(Read, ResourceCharges)
+
+	key, err := NewSigningKey(AlgorithmEd25519)
+	assert.Nil(err)
+	private := &Keyring{Keys: []*SigningKey{key}}
+
+	signed, err := Sign(&Claims{Permission: p}, private)
+	assert.Nil(err)
+
+	// The proxy only needs the public key to verify
+	public, err := private.Public()
+	assert.Nil(err)
+	assert.Nil(public.Keys[0].Secret)
+
+	c, err := Verify(signed, public)
+	assert.Nil(err)
+	assert.Equal(AlgorithmEd25519, c.Algorithm)
+	assert.True(c.Permission.Can(Read, ResourceCharges))
+
+	// But it can't sign with it
+	_, err = Sign(&Claims{Permission: p}, public)
+	assert.NotNil(err)
+
+	// The public keyring survives a round trip through JSON
+	data, err := json.Marshal(public)
+	assert.Nil(err)
+	parsed, err := ParseKeyring(data)
+	assert.Nil(err)
+	_, err = Verify(signed, parsed)
+	assert.Nil(err)
+
+	// Tampering with the claims breaks the signature
+	tampered := "A" + signed[1:]
+	_, err = Verify(tampered, public)
+	assert.NotNil(err)
+}
+
+func TestAlgorithmConfusion(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Permission{}
+	p.SetAccess(ReadWrite, ResourceAll)
+
+	key, err := NewSigningKey(AlgorithmEd25519)
+	assert.Nil(err)
+	public, err := (&Keyring{Keys: []*SigningKey{key}}).Public()
+	assert.Nil(err)
+
+	// Anyone holding the public key could compute an HMAC with it, so the
+	// proxy must not accept HMAC credentials for an Ed25519 key ID.
+	forger := &Keyring{Keys: []*SigningKey{
+		{ID: key.ID, Algorithm: AlgorithmHMACSHA256, Secret: key.PublicKey},
+	}}
+	forged, err := Sign(&Claims{Permission: p}, forger)
+	assert.Nil(err)
+
+	_, err = Verify(forged, public)
+	assert.NotNil(err)
+}
@@ -0,0 +1,158 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// spendingResources are the resources whose creation moves money, mapped to
+// whether the currency is a parameter of the request. Refunds are always in
+// the currency of their charge, see checkRefundCurrency.
+var spendingResources = map[StripeResource]bool{
+	ResourceCharges:       true,
+	ResourcePaymentIntent: true,
+	ResourcePayout:        true,
+	ResourceRefunds:       false,
+	ResourceTransfers:     true,
+}
+
+// refundedObjects are the parameters which name what a refund is of, mapped
+// to where they are looked up.
+var refundedObjects = map[string]string{
+	"charge":         "/v1/charges",
+	"payment_intent": "/v1/payment_intents",
+}
+
+func validateLimits(maxAmount int64, currencies []string) error {
+	if maxAmount < 0 {
+		return errors.New("The maximum amount must not be negative")
+	}
+	if currencies != nil && len(currencies) == 0 {
+		return errors.New("At least one currency must be allowed")
+	}
+	for _, currency := range currencies {
+		if len(currency) != 3 || strings.Trim(currency, "abcdefghijklmnopqrstuvwxyz") != "" {
+			return fmt.Errorf("Currency %q must be a lowercase ISO currency code", currency)
+		}
+	}
+	return nil
+}
+
+// singleParam returns the value of a parameter which may only be specified
+// once, or the empty string if it is missing.
+func singleParam(params url.Values, key string) (string, error) {
+	values := params[key]
+	if len(values) > 1 {
+		return "", fmt.Errorf("The %s parameter must only be specified once", key)
+	}
+	if len(values) == 0 {
+		return "", nil
+	}
+	return values[0], nil
+}
+
+// checkSpendingLimits enforces the maximum amount and allowed currencies of a
+// credential. Creating an object must state an amount and currency which are
+// within the limits, since the defaults can't be checked, e.g. refunding the
+// whole charge. Updates, such as changing the amount of a payment intent, are
+// checked when they change either.
+func checkSpendingLimits(claims *Claims, rr resourceRoute, params url.Values) *ErrorResponse {
+	if claims.MaxAmount == 0 && claims.Currencies == nil {
+		return nil
+	}
+	currencyParam, ok := spendingResources[rr.resource]
+	if !ok || (rr.access != Create && rr.access != Update) {
+		return nil
+	}
+	create := rr.access == Create
+
+	amount, err := singleParam(params, "amount")
+	if err != nil {
+		return invalidRequestError(err.Error())
+	}
+	if claims.MaxAmount != 0 && (amount != "" || create) {
+		if amount == "" {
+			return validButInsufficientError(fmt.Sprintf("Credential requires the amount to be specified, up to %d", claims.MaxAmount))
+		}
+		value, err := strconv.ParseInt(amount, 10, 64)
+		if err != nil || value < 0 {
+			return invalidRequestError(fmt.Sprintf("Invalid amount %q", amount))
+		}
+		if value > claims.MaxAmount {
+			return validButInsufficientError(fmt.Sprintf("Amount %d exceeds the credential's maximum of %d", value, claims.MaxAmount))
+		}
+	}
+
+	currency, err := singleParam(params, "currency")
+	if err != nil {
+		return invalidRequestError(err.Error())
+	}
+	if claims.Currencies != nil && currencyParam && (currency != "" || create) {
+		if currency == "" {
+			return validButInsufficientError(fmt.Sprintf("Credential requires the currency to be one of %s", strings.Join(claims.Currencies, ", ")))
+		}
+		if !inScope(claims.Currencies, strings.ToLower(currency)) {
+			return validButInsufficientError(fmt.Sprintf("Credential does not allow the currency %s", currency))
+		}
+	}
+	return nil
+}
+
+// refundedPaths returns the paths of the charges and payment intents which a
+// request creating a refund is of.
+func refundedPaths(rr resourceRoute, req *http.Request, params url.Values) []string {
+	var paths []string
+	if path, _ := objectPath(rr.path, req); path != "" {
+		paths = append(paths, path)
+	}
+	for param, collection := range refundedObjects {
+		for _, id := range params[param] {
+			paths = append(paths, collection+"/"+url.PathEscape(id))
+		}
+	}
+	return paths
+}
+
+// checkRefundCurrency enforces the allowed currencies of a credential on the
+// refunds it creates, which have no currency parameter, by looking up the
+// currency of the refunded charge or payment intent.
+func (p *permissionsProxy) checkRefundCurrency(claims *Claims, stripeKey string, rr resourceRoute, req *http.Request, params url.Values) *ErrorResponse {
+	if claims.Currencies == nil || rr.resource != ResourceRefunds || rr.access != Create {
+		return nil
+	}
+
+	paths := refundedPaths(rr, req, params)
+	if len(paths) == 0 {
+		return validButInsufficientError("Unable to check the currency of the refund")
+	}
+	for _, path := range paths {
+		var object struct {
+			Currency string `json:"currency"`
+		}
+		if err := p.lookupObject(path, stripeKey, req, &object); err != nil {
+			return validButInsufficientError(fmt.Sprintf("Unable to check the currency of %s", path))
+		}
+		if !inScope(claims.Currencies, strings.ToLower(object.Currency)) {
+			return validButInsufficientError(fmt.Sprintf("Credential does not allow the currency %s", object.Currency))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpendingLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	proxy, _ := newTeapotProxy()
+	signed, err := Sign(&Claims{Permission: NewPermission(3), MaxAmount: 5000, Currencies: []string{"usd", "eur"}}, newTestKeyring())
+	assert.Nil(err)
+
+	for _, tt := range []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		// Within the limits
+		{"POST", "/v1/charges", "amount=5000&currency=usd&source=tok_visa", 418},
+		{"POST", "/v1/payment_intents", "amount=100&currency=EUR", 418},
+		{"POST", "/v1/payouts", "amount=100&currency=eur", 418},
+		{"POST", "/v1/transfers", "amount=100&currency=usd&destination=acct_123", 418},
+		{"POST", "/v1/payment_intents/pi_123", "description=unchanged", 418},
+		{"POST", "/v1/customers", "email=jenny@example.com", 418},
+		{"GET", "/v1/charges?amount=10000", "", 418},
+
+		// Above the maximum amount
+		{"POST", "/v1/charges", "amount=5001&currency=usd", 403},
+		{"POST", "/v1/transfers", "amount=1000000&currency=usd", 403},
+		{"POST", "/v1/payment_intents/pi_123", "amount=9999", 403},
+
+		// Other currencies
+		{"POST", "/v1/payouts", "amount=100&currency=gbp", 403},
+		{"POST", "/v1/payment_intents/pi_123", "currency=jpy", 403},
+
+		// Amounts and currencies which can't be checked
+		{"POST", "/v1/charges", "currency=usd", 403},
+		{"POST", "/v1/payment_intents", "amount=100", 403},
+		{"POST", "/v1/charges", "amount=100&amount=100000&currency=usd", 400},
+		{"POST", "/v1/charges", "amount=1e9&currency=usd", 400},
+		{"POST", "/v1/charges", "amount=-1&currency=usd", 400},
+	} {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(signed, "")
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(tt.status, rw.Code, "%s %s %s", tt.method, tt.path, tt.body)
+	}
+
+	// Bodies which aren't forms can't be checked
+	for _, contentType := range []string{"application/json", "text/plain"} {
+		req := httptest.NewRequest("POST", "/v1/charges", strings.NewReader(`{"amount": 1000000, "currency": "usd"}`))
+		req.Header.Set("Content-Type", contentType)
+		req.SetBasicAuth(signed, "")
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(400, rw.Code, contentType)
+	}
+}
+
+func TestRefundLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	upstream := &objectUpstream{objects: map[string]string{
+		"/v1/charges/ch_usd":         `{"id": "ch_usd", "currency": "usd"}`,
+		"/v1/charges/ch_gbp":         `{"id": "ch_gbp", "currency": "gbp"}`,
+		"/v1/payment_intents/pi_eur": `{"id": "pi_eur", "currency": "EUR"}`,
+		"/v1/payment_intents/pi_jpy": `{"id": "pi_jpy", "currency": "jpy"}`,
+	}}
+	proxy := NewStripePermissionsProxy(proxyTestStripeKey, newTestKeyring(), upstream)
+	signed, err := Sign(&Claims{Permission: NewPermission(3), MaxAmount: 5000, Currencies: []string{"usd", "eur"}}, newTestKeyring())
+	assert.Nil(err)
+
+	for _, tt := range []struct {
+		path   string
+		body   string
+		status int
+	}{
+		// Refunds of charges and payment intents in allowed currencies
+		{"/v1/refunds", "charge=ch_usd&amount=100", 404},
+		{"/v1/refunds", "payment_intent=pi_eur&amount=5000", 404},
+		{"/v1/charges/ch_usd/refunds", "amount=100", 404},
+
+		// Other currencies
+		{"/v1/refunds", "charge=ch_gbp&amount=100", 403},
+		{"/v1/refunds", "payment_intent=pi_jpy&amount=100", 403},
+		{"/v1/charges/ch_gbp/refunds", "amount=100", 403},
+		{"/v1/charges/ch_usd/refunds", "amount=100&charge=ch_gbp", 403},
+
+		// Refunds which can't be checked
+		{"/v1/refunds", "charge=ch_usd", 403},
+		{"/v1/refunds", "charge=ch_usd&amount=5001", 403},
+		{"/v1/refunds", "amount=100", 403},
+		{"/v1/refunds", "charge=ch_missing&amount=100", 403},
+	} {
+		upstream.requests = nil
+		req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(signed, "")
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(tt.status, rw.Code, "%s %s", tt.path, tt.body)
+		if tt.status == 403 {
+			for _, forwarded := range upstream.requests {
+				assert.True(strings.HasPrefix(forwarded, "GET "), "%s %s should not be forwarded", tt.path, tt.body)
+			}
+		}
+	}
+}
+
+func TestAttenuatedSpendingLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	keys := newTestKeyring()
+	signed, err := Sign(&Claims{Permission: NewPermission(3), MaxAmount: 5000}, keys)
+	assert.Nil(err)
+
+	for _, tt := range []struct {
+		caveat     *Caveat
+		maxAmount  int64
+		currencies []string
+	}{
+		{&Caveat{MaxAmount: 100}, 100, nil},
+		{&Caveat{MaxAmount: 10000}, 5000, nil},
+		{&Caveat{Currencies: []string{"usd"}}, 5000, []string{"usd"}},
+	} {
+		attenuated, err := Attenuate(signed, tt.caveat)
+		assert.Nil(err)
+		claims, err := Verify(attenuated, keys)
+		assert.Nil(err)
+		assert.Equal(tt.maxAmount, claims.MaxAmount)
+		assert.Equal(tt.currencies, claims.Currencies)
+	}
+
+	for _, invalid := range []*Claims{
+		{Permission: NewPermission(3), MaxAmount: -1},
+		{Permission: NewPermission(3), Currencies: []string{}},
+		{Permission: NewPermission(3), Currencies: []string{"USD"}},
+		{Permission: NewPermission(3), Currencies: []string{"dollars"}},
+	} {
+		_, err := Sign(invalid, keys)
+		assert.NotNil(err)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons for which credentials fail verification. They are deliberately
+// coarse, so that the metrics never carry anything about the credential.
+const (
+	verificationMissing         = "missing"
+	verificationInvalid         = "invalid"
+	verificationUnknownUpstream = "unknown_upstream"
+	verificationRevoked         = "revoked"
+)
+
+// Metrics counts the requests which the proxy handles. None of the labels
+// identify a credential.
+type Metrics struct {
+	requests             *prometheus.CounterVec
+	upstreamDuration     *prometheus.HistogramVec
+	verificationFailures *prometheus.CounterVec
+}
+
+// NewMetrics creates the proxy's metrics and registers them.
+func NewMetrics(registerer prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "stripe_proxy",
+			Name:      "requests_total",
+			Help:      "Requests by resource, access, decision and response status.",
+		}, []string{"resource", "access", "decision", "status"}),
+		upstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "stripe_proxy",
+			Name:      "upstream_duration_seconds",
+			Help:      "Time taken by Stripe to answer forwarded requests.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"resource", "status"}),
+		verificationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "stripe_proxy",
+			Name:      "credential_verification_failures_total",
+			Help:      "Requests whose credential was missing, invalid, revoked or for an unknown upstream.",
+		}, []string{"reason"}),
+	}
+	registerer.MustRegister(m.requests, m.upstreamDuration, m.verificationFailures)
+	return m
+}
+
+// WithMetrics records every request in the metrics.
+func WithMetrics(m *Metrics) Option {
+	return func(p *permissionsProxy) {
+		p.metrics = m
+	}
+}
+
+// observe records a completed request, and how long Stripe took to answer it
+// if it was forwarded. Metrics may be nil.
+func (m *Metrics) observe(rr resourceRoute, event *AuditEvent, upstream time.Duration) {
+	if m == nil {
+		return
+	}
+
+	status := strconv.Itoa(event.Status)
+	m.requests.WithLabelValues(rr.resource.String(), rr.access.String(), event.Decision, status).Inc()
+	if event.Decision == DecisionAllowed {
+		m.upstreamDuration.WithLabelValues(rr.resource.String(), status).Observe(upstream.Seconds())
+	}
+}
+
+// verificationFailed counts a credential which was not accepted.
+func (m *Metrics) verificationFailed(reason string) {
+	if m == nil {
+		return
+	}
+	m.verificationFailures.WithLabelValues(reason).Inc()
+}
@@ -0,0 +1,118 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry)
+	keys := newTestKeyring()
+	revocations := &RevocationList{}
+	proxy := NewStripePermissionsProxy(proxyTestStripeKey, keys, &requestIDUpstream{}, WithMetrics(metrics), WithRevocations(revocations))
+
+	claims := &Claims{ID: "measured", Permission: &Permission{}}
+	claims.Permission.SetAccess(Create, ResourceRefunds)
+	signed, err := Sign(claims, keys)
+	assert.Nil(err)
+	revoked, err := Sign(&Claims{ID: "revoked", Permission: NewPermission(3)}, keys)
+	assert.Nil(err)
+	assert.Nil(revocations.Revoke("revoked", ""))
+	elsewhere, err := Sign(&Claims{Permission: NewPermission(3), Upstream: "eu"}, keys)
+	assert.Nil(err)
+
+	serve := func(credentials, method, path string) {
+		req := httptest.NewRequest(method, path, nil)
+		if credentials != "" {
+			req.SetBasicAuth(credentials, "")
+		}
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve(signed, "POST", "/v1/refunds")
+	serve(signed, "POST", "/v1/refunds")
+	serve(signed, "DELETE", "/v1/customers/cus_123")
+	serve("forged", "GET", "/v1/charges")
+	serve("", "GET", "/v1/charges")
+	serve(revoked, "GET", "/v1/charges")
+	serve(elsewhere, "GET", "/v1/charges")
+
+	assert.Equal(2.0, testutil.ToFloat64(metrics.requests.WithLabelValues("refunds", "create", DecisionAllowed, "201")))
+	assert.Equal(1.0, testutil.ToFloat64(metrics.requests.WithLabelValues("customers", "delete", DecisionDenied, "403")))
+	assert.Equal(4.0, testutil.ToFloat64(metrics.requests.WithLabelValues("charges", "list", DecisionDenied, "403")))
+	assert.Equal(1, testutil.CollectAndCount(metrics.upstreamDuration))
+	assert.Equal(1.0, testutil.ToFloat64(metrics.verificationFailures.WithLabelValues(verificationInvalid)))
+	assert.Equal(1.0, testutil.ToFloat64(metrics.verificationFailures.WithLabelValues(verificationMissing)))
+	assert.Equal(1.0, testutil.ToFloat64(metrics.verificationFailures.WithLabelValues(verificationRevoked)))
+	assert.Equal(1.0, testutil.ToFloat64(metrics.verificationFailures.WithLabelValues(verificationUnknownUpstream)))
+
+	// The exposition never contains credentials
+	rw := httptest.NewRecorder()
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	body := rw.Body.String()
+	assert.Contains(body, "stripe_proxy_upstream_duration_seconds_count")
+	for _, secret := range []string{signed, revoked, elsewhere, "forged", "measured", proxyTestStripeKey} {
+		assert.False(strings.Contains(body, secret), secret)
+	}
+}
+
+// slowLedger takes its time to check and record spending.
+type slowLedger struct{}
+
+func (slowLedger) Entries(id string, since time.Time) ([]LedgerEntry, error) {
+	time.Sleep(100 * time.Millisecond)
+	return nil, nil
+}
+
+func (slowLedger) Record(entry LedgerEntry) error {
+	time.Sleep(100 * time.Millisecond)
+	return nil
+}
+
+func TestUpstreamDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+	keys := newTestKeyring()
+	proxy := NewStripePermissionsProxy(proxyTestStripeKey, keys, &amountUpstream{}, WithMetrics(metrics), WithBudgetLedger(slowLedger{}, nil))
+
+	signed, err := Sign(&Claims{ID: "slow", Permission: NewPermission(3), Currencies: []string{"usd"}, Budget: 1000, BudgetWindow: time.Hour}, keys)
+	assert.Nil(err)
+	req := httptest.NewRequest("POST", "/v1/charges", strings.NewReader("amount=100&currency=usd"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(signed, "")
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(200, rw.Code)
+
+	// Only Stripe's time counts, not the budget's
+	var m dto.Metric
+	assert.Nil(metrics.upstreamDuration.WithLabelValues("charges", "200").(prometheus.Metric).Write(&m))
+	assert.Equal(uint64(1), m.GetHistogram().GetSampleCount())
+	assert.True(m.GetHistogram().GetSampleSum() < 0.1, "%v", m.GetHistogram().GetSampleSum())
+}
@@ -0,0 +1,75 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Mode is whether a credential works with Stripe's test or live data.
+type Mode string
+
+const (
+	// ModeDefault credentials use the proxy's default Stripe key, whatever
+	// its mode. Credentials which were signed before modes have it.
+	ModeDefault Mode = ""
+	ModeTest    Mode = "test"
+	ModeLive    Mode = "live"
+)
+
+// Modes are encoded as a single byte in credentials.
+var modeBytes = map[Mode]byte{
+	ModeTest: 1,
+	ModeLive: 2,
+}
+
+// ParseMode parses test or live.
+func ParseMode(s string) (Mode, error) {
+	mode := Mode(s)
+	if _, ok := modeBytes[mode]; !ok {
+		return ModeDefault, fmt.Errorf("Unknown mode %q, must be test or live", s)
+	}
+	return mode, nil
+}
+
+func (m Mode) String() string {
+	if m == ModeDefault {
+		return "default"
+	}
+	return string(m)
+}
+
+var keyModePattern = regexp.MustCompile(`^[a-z]+_(test|live)_`)
+
+// KeyMode finds the mode of a Stripe key from its prefix, e.g. sk_test_ or
+// rk_live_, or ModeDefault if the prefix is unknown.
+func KeyMode(key string) Mode {
+	match := keyModePattern.FindStringSubmatch(key)
+	if match == nil {
+		return ModeDefault
+	}
+	return Mode(match[1])
+}
+
+// WithModeKeys adds the Stripe keys for credentials of the test and live
+// modes. Either may be empty, in which case the default key is used if it is
+// of that mode. Keys whose prefix doesn't match their mode are never used.
+func WithModeKeys(testKey, liveKey string) Option {
+	return func(p *permissionsProxy) {
+		p.upstream.TestKey = testKey
+		p.upstream.LiveKey = liveKey
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// keyUpstream records the Stripe key of each request.
+type keyUpstream struct {
+	keys []string
+}
+
+func (u *keyUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	key, _, _ := req.BasicAuth()
+	u.keys = append(u.keys, key)
+}
+
+func TestKeyMode(t *testing.T) {
+	assert := assert.New(t)
+
+	for key, mode := range map[string]Mode{
+		"sk_test_123":  ModeTest,
+		"rk_test_123":  ModeTest,
+		"sk_live_123":  ModeLive,
+		"rk_live_123":  ModeLive,
+		"sk_123":       ModeDefault,
+		"":             ModeDefault,
+		"sk_testing_1": ModeDefault,
+		"x sk_test_1":  ModeDefault,
+	} {
+		assert.Equal(mode, KeyMode(key), key)
+	}
+
+	for _, valid := range []Mode{ModeTest, ModeLive} {
+		mode, err := ParseMode(string(valid))
+		assert.Nil(err)
+		assert.Equal(valid, mode)
+	}
+	_, err := ParseMode("production")
+	assert.NotNil(err)
+}
+
+func TestModeKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	keys := newTestKeyring()
+	sign := func(mode Mode) string {
+		signed, err := Sign(&Claims{Permission: NewPermission(1), Mode: mode}, keys)
+		assert.Nil(err)
+		return signed
+	}
+
+	for _, tt := range []struct {
+		defaultKey string
+		testKey    string
+		liveKey    string
+		mode       Mode
+		expected   string
+	}{
+		{"sk_live_default", "sk_test_123", "sk_live_456", ModeDefault, "sk_live_default"},
+		{"sk_live_default", "sk_test_123", "sk_live_456", ModeTest, "sk_test_123"},
+		{"sk_live_default", "sk_test_123", "sk_live_456", ModeLive, "sk_live_456"},
+
+		// The default key is used for its own mode
+		{"sk_live_default", "sk_test_123", "", ModeLive, "sk_live_default"},
+		{"sk_test_default", "", "", ModeTest, "sk_test_default"},
+
+		// Credentials of a mode without a key are never forwarded
+		{"sk_live_default", "", "sk_live_456", ModeTest, ""},
+		{"", "sk_test_123", "", ModeLive, ""},
+		{"sk_live_default", "sk_live_oops", "", ModeTest, ""},
+		{"pk_default", "", "", ModeLive, ""},
+		{"", "sk_test_123", "sk_live_456", ModeDefault, ""},
+	} {
+		upstream := &keyUpstream{}
+		proxy := NewStripePermissionsProxy(tt.defaultKey, keys, upstream, WithModeKeys(tt.testKey, tt.liveKey))
+
+		req := httptest.NewRequest("GET", "/v1/charges", nil)
+		req.SetBasicAuth(sign(tt.mode), "")
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+
+		if tt.expected == "" {
+			assert.Equal(500, rw.Code)
+			assert.Empty(upstream.keys)
+		} else {
+			assert.Equal([]string{tt.expected}, upstream.keys, "%s credential with %+v", tt.mode, tt)
+		}
+	}
+
+	// The mode survives attenuation
+	attenuated, err := Attenuate(sign(ModeTest), &Caveat{Permission: NewPermission(1)})
+	assert.Nil(err)
+	claims, err := Verify(attenuated, keys)
+	assert.Nil(err)
+	assert.Equal(ModeTest, claims.Mode)
+
+	_, err = Sign(&Claims{Permission: NewPermission(1), Mode: Mode("staging")}, keys)
+	assert.NotNil(err)
+}
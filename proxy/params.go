@@ -0,0 +1,104 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+)
+
+// maxBodyLength limits how much of a request body is buffered to check its
+// parameters.
+const maxBodyLength = 32 << 20
+
+// errUncheckedBody is returned with the query parameters of a request whose
+// body is not a form, and so can't be checked.
+var errUncheckedBody = errors.New("Request body must be application/x-www-form-urlencoded or multipart/form-data")
+
+// requestParams reads the parameters of a request from both the query and
+// form bodies. The body is restored so that the request can still be
+// forwarded.
+func requestParams(req *http.Request) (url.Values, error) {
+	params := req.URL.Query()
+
+	if req.Body == nil {
+		return params, nil
+	}
+
+	// Bodies without a content type are treated as forms so that they
+	// can't be used to hide parameters.
+	contentType := req.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/x-www-form-urlencoded"
+	}
+	mediaType, mediaParams, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	form := mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data"
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBodyLength+1))
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxBodyLength {
+		return nil, errors.New("Request body is too large")
+	}
+	if !form {
+		if len(body) > 0 {
+			return params, errUncheckedBody
+		}
+		return params, nil
+	}
+
+	var values url.Values
+	if mediaType == "multipart/form-data" {
+		form, err := multipart.NewReader(bytes.NewReader(body), mediaParams["boundary"]).ReadForm(maxBodyLength)
+		if err != nil {
+			return nil, err
+		}
+		defer form.RemoveAll()
+		values = url.Values(form.Value)
+	} else {
+		values, err = url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for key, vs := range values {
+		params[key] = append(params[key], vs...)
+	}
+	return params, nil
+}
+
+// paramsRestricted reports whether the credential restricts the parameters
+// of requests to the route, whose bodies then have to be checked.
+func paramsRestricted(claims *Claims, rr resourceRoute) bool {
+	if claims.Customers != nil {
+		return true
+	}
+	_, spending := spendingResources[rr.resource]
+	limited := claims.MaxAmount != 0 || claims.Currencies != nil || claims.Budget != 0
+	return spending && limited && rr.access&Write != 0
+}
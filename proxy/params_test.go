@@ -0,0 +1,90 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestParams(t *testing.T) {
+	assert := assert.New(t)
+
+	req := httptest.NewRequest("GET", "/v1/charges?customer=cus_123&expand[]=customer", nil)
+	params, err := requestParams(req)
+	assert.Nil(err)
+	assert.Equal(url.Values{"customer": {"cus_123"}, "expand[]": {"customer"}}, params)
+
+	// Form bodies are merged with the query and then restored for the upstream
+	body := "amount=100&expand[1]=latest_invoice"
+	req = httptest.NewRequest("POST", "/v1/subscriptions?expand[]=customer", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	params, err = requestParams(req)
+	assert.Nil(err)
+	assert.Equal(url.Values{"amount": {"100"}, "expand[]": {"customer"}, "expand[1]": {"latest_invoice"}}, params)
+	forwarded, err := ioutil.ReadAll(req.Body)
+	assert.Nil(err)
+	assert.Equal(body, string(forwarded))
+
+	// Bodies without a content type are still treated as forms
+	req = httptest.NewRequest("POST", "/v1/charges", strings.NewReader("customer=cus_123"))
+	params, err = requestParams(req)
+	assert.Nil(err)
+	assert.Equal("cus_123", params.Get("customer"))
+
+	// Multipart bodies
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	w.WriteField("purpose", "dispute_evidence")
+	w.WriteField("expand[]", "links")
+	w.Close()
+	req = httptest.NewRequest("POST", "/v1/files", bytes.NewReader(buf.Bytes()))
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	params, err = requestParams(req)
+	assert.Nil(err)
+	assert.Equal("links", params.Get("expand[]"))
+	forwarded, err = ioutil.ReadAll(req.Body)
+	assert.Nil(err)
+	assert.Equal(buf.Bytes(), forwarded)
+
+	// JSON bodies aren't forms
+	req = httptest.NewRequest("POST", "/v1/charges", strings.NewReader(`{"customer": "cus_123"}`))
+	req.Header.Set("Content-Type", "application/json")
+	params, err = requestParams(req)
+	assert.Equal(errUncheckedBody, err)
+	assert.Empty(params)
+	forwarded, err = ioutil.ReadAll(req.Body)
+	assert.Nil(err)
+	assert.Equal(`{"customer": "cus_123"}`, string(forwarded))
+
+	// Other content types without a body are fine
+	req = httptest.NewRequest("GET", "/v1/charges?limit=3", nil)
+	req.Header.Set("Content-Type", "application/json")
+	params, err = requestParams(req)
+	assert.Nil(err)
+	assert.Equal("3", params.Get("limit"))
+
+	// Malformed bodies are rejected
+	req = httptest.NewRequest("POST", "/v1/charges", strings.NewReader("customer=%zz"))
+	_, err = requestParams(req)
+	assert.NotNil(err)
+}
@@ -16,101 +16,366 @@ package proxy
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
 )
 
+//go:generate go run ../openapi/routegen/main.go -spec ../openapi/spec3.excerpt.json -registry ../openapi/resources.json -output resources_gen.go
+
+// StripeResource is a family of Stripe API paths which permissions are
+// granted for. The resources, their grammar names and their routes are
+// generated from the registry in openapi/resources.json.
 type StripeResource int
 
-// Note: these do not use iota so that they are stable through modifications
-// of the list.
-const (
-	ResourceAll StripeResource = 0
-
-	// Core resources
-	ResourceBalance           = 1
-	ResourceCharges           = 2
-	ResourceCustomers         = 3
-	ResourceDisputes          = 4
-	ResourceEvents            = 5
-	ResourceFileUploads       = 6
-	ResourceRefunds           = 7
-	ResourceTokens            = 8
-	ResourceTransfers         = 9
-	ResourceTransferReversals = 10
-
-	// Connect resources
-	ResourceAccount              = 11
-	ResourceApplicationFeeRefund = 12
-	ResourceApplicationFee       = 13
-	ResourceRecipient            = 14
-	ResourceCountrySpec          = 15
-	ResourceExternalAccount      = 16
-
-	// Payment methods
-	ResourceSource = 17
-
-	// Relay resources
-	ResourceOrder       = 18
-	ResourceOrderReturn = 19
-	ResourceProduct     = 20
-	ResourceSKU         = 21
-
-	// Subscription resources
-	ResourceCoupon           = 22
-	ResourceInvoice          = 23
-	ResourceInvoiceItem      = 24
-	ResourcePlan             = 25
-	ResourceSubscription     = 26
-	ResourceSubscriptionItem = 27
-
-	// Radar resources
-	ResourceRadarReview = 28
-	ResourceRadarRule   = 29
-)
+func (r StripeResource) String() string {
+	if name, ok := resourceNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("resource(%d)", int(r))
+}
+
+// ParseResource finds the resource with the specified grammar name.
+func ParseResource(name string) (StripeResource, error) {
+	for resource, resourceName := range resourceNames {
+		if resourceName == name {
+			return resource, nil
+		}
+	}
+	return ResourceAll, fmt.Errorf("Unknown resource %q", name)
+}
 
+// Access is the set of operations which are allowed on a resource.
 type Access int
 
 // Note: these do not use iota so that they are stable through modifications
 // of the list.
 const (
-	None      = 0
-	Read      = 1
-	Write     = 2
-	ReadWrite = 3
+	None     = 0
+	List     = 1
+	Retrieve = 2
+	Create   = 4
+	Update   = 8
+	Delete   = 16
+
+	// Read and Write are the groups of operations which were the only access
+	// levels before individual operations could be granted.
+	Read      = List | Retrieve
+	Write     = Create | Update | Delete
+	ReadWrite = Read | Write
 )
 
+var accessNames = map[Access]string{
+	None:      "none",
+	Read:      "read",
+	Write:     "write",
+	ReadWrite: "rw",
+	List:      "list",
+	Retrieve:  "retrieve",
+	Create:    "create",
+	Update:    "update",
+	Delete:    "delete",
+}
+
+// accessParts are the names which an access is rendered with, largest
+// group first.
+var accessParts = []Access{ReadWrite, Read, Write, List, Retrieve, Create, Update, Delete}
+
+func (a Access) String() string {
+	if name, ok := accessNames[a]; ok {
+		return name
+	}
+	if a&^ReadWrite != 0 {
+		return fmt.Sprintf("access(%d)", int(a))
+	}
+
+	var parts []string
+	remaining := a
+	for _, part := range accessParts {
+		if remaining&part == part {
+			parts = append(parts, accessNames[part])
+			remaining &^= part
+		}
+	}
+	return strings.Join(parts, "+")
+}
+
+// ParseAccess finds the access with the specified grammar name, or the
+// combination of names joined with a +, e.g. "read+create".
+func ParseAccess(name string) (Access, error) {
+	var access Access
+	for _, part := range strings.Split(name, "+") {
+		found := false
+		for candidate, candidateName := range accessNames {
+			if candidateName == part {
+				access |= candidate
+				found = true
+				break
+			}
+		}
+		if !found {
+			return None, fmt.Errorf("Unknown access %q, must be one of read, write, rw, list, retrieve, create, update or delete, or several joined with +", part)
+		}
+	}
+	return access, nil
+}
+
+// Permission is the access which is granted to each resource. The binary
+// form is a variable length bitset with two bits per resource, one each for
+// the read and write groups, kept in 64 bit words which each hold 32
+// resources so that new resources can keep being appended. Permissions
+// which only use the first 32 resources marshal to the same 8 bytes as the
+// fixed size vector which preceded the bitset.
+//
+// Access to individual operations which doesn't make up a whole group is
+// marshalled separately by marshalOperations.
 type Permission struct {
-	encoded uint64
+	access []Access
 }
 
+// The bits of each resource in the binary form.
+const (
+	readBit  = 1
+	writeBit = 2
+)
+
+const (
+	resourcesPerWord = 32
+	wordLength       = 8
+)
+
+// NewPermission creates a permission from the vector of the first 32
+// resources.
 func NewPermission(initialValue uint64) *Permission {
-	return &Permission{initialValue}
+	p := &Permission{}
+	p.setWord(0, initialValue)
+	return p
+}
+
+// trim drops trailing resources without access so that equal permissions
+// compare equal.
+func (p *Permission) trim() {
+	for len(p.access) > 0 && p.access[len(p.access)-1] == None {
+		p.access = p.access[:len(p.access)-1]
+	}
+	if len(p.access) == 0 {
+		p.access = nil
+	}
+}
+
+func (p *Permission) get(resource StripeResource) Access {
+	if int(resource) >= len(p.access) {
+		return None
+	}
+	return p.access[resource]
+}
+
+func resourceMask(bits uint64, resource StripeResource) uint64 {
+	return bits << (uint64(resource%resourcesPerWord) * 2)
+}
+
+// setWord grants the groups in the word of the binary form with index i.
+func (p *Permission) setWord(i int, word uint64) {
+	for offset := 0; offset < resourcesPerWord; offset++ {
+		resource := StripeResource(i*resourcesPerWord + offset)
+		if word&resourceMask(readBit, resource) != 0 {
+			p.SetAccess(Read, resource)
+		}
+		if word&resourceMask(writeBit, resource) != 0 {
+			p.SetAccess(Write, resource)
+		}
+	}
+}
+
+// words encodes the groups which are granted in full.
+func (p *Permission) words() []uint64 {
+	words := make([]uint64, (len(p.access)+resourcesPerWord-1)/resourcesPerWord)
+	for i, access := range p.access {
+		resource := StripeResource(i)
+		if access&Read == Read {
+			words[i/resourcesPerWord] |= resourceMask(readBit, resource)
+		}
+		if access&Write == Write {
+			words[i/resourcesPerWord] |= resourceMask(writeBit, resource)
+		}
+	}
+
+	for len(words) > 0 && words[len(words)-1] == 0 {
+		words = words[:len(words)-1]
+	}
+	return words
 }
 
+// marshalGroups encodes the binary form of the read and write groups,
+// leaving out any individual operations.
+func (p *Permission) marshalGroups() []byte {
+	words := p.words()
+	if len(words) == 0 {
+		words = []uint64{0}
+	}
+
+	bs := make([]byte, len(words)*wordLength)
+	for i, word := range words {
+		binary.BigEndian.PutUint64(bs[i*wordLength:], word)
+	}
+	return bs
+}
+
+// MarshalBinary encodes the read and write groups. Permissions which grant
+// individual operations can only be encoded in credentials.
 func (p *Permission) MarshalBinary() ([]byte, error) {
-	bs := make([]byte, 8)
-	binary.BigEndian.PutUint64(bs, p.encoded)
-	return bs, nil
+	if p.marshalOperations() != nil {
+		return nil, errors.New("Permission with individual operations can't be encoded as read and write groups")
+	}
+	return p.marshalGroups(), nil
 }
 
-func (p *Permission) BinaryUnmarshaler(data []byte) error {
-	p.encoded = binary.BigEndian.Uint64(data)
+func (p *Permission) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 || len(data)%wordLength != 0 {
+		return errors.New("Invalid permission length")
+	}
+
+	*p = Permission{}
+	for i := 0; i < len(data)/wordLength; i++ {
+		p.setWord(i, binary.BigEndian.Uint64(data[i*wordLength:]))
+	}
 	return nil
 }
 
-func resourceMask(access Access, resources ...StripeResource) uint64 {
-	var mask uint64
-	for _, resource := range resources {
-		mask |= uint64(access << (uint64(resource) * 2))
+// marshalOperations encodes the operations of every resource as one byte
+// each, or returns nil if the groups already describe the permission.
+func (p *Permission) marshalOperations() []byte {
+	representable := true
+	for _, access := range p.access {
+		if access != None && access != Read && access != Write && access != ReadWrite {
+			representable = false
+		}
+	}
+	if representable {
+		return nil
+	}
+
+	bs := make([]byte, len(p.access))
+	for i, access := range p.access {
+		bs[i] = byte(access)
+	}
+	return bs
+}
+
+// unmarshalOperations adds the operations encoded by marshalOperations.
+func (p *Permission) unmarshalOperations(data []byte) error {
+	for i, b := range data {
+		access := Access(b)
+		if access&^ReadWrite != 0 {
+			return errors.New("Invalid permission operations")
+		}
+		p.SetAccess(access, StripeResource(i))
 	}
-	return mask
+	return nil
+}
+
+// numResources is how many resources have an entry in the permission.
+func (p *Permission) numResources() StripeResource {
+	return StripeResource(len(p.access))
 }
 
+// Can reports whether all of the access is granted to every one of the
+// resources, either directly or through ResourceAll.
 func (p *Permission) Can(access Access, resources ...StripeResource) bool {
-	mask := resourceMask(access, resources...)
-	allMask := resourceMask(access, ResourceAll)
-	return mask&p.encoded == mask || allMask&p.encoded == allMask
+	all := p.get(ResourceAll)
+	if all&access == access {
+		return true
+	}
+	for _, resource := range resources {
+		if (p.get(resource)|all)&access != access {
+			return false
+		}
+	}
+	return true
 }
 
 func (p *Permission) SetAccess(access Access, resources ...StripeResource) {
-	p.encoded |= resourceMask(access, resources...)
+	for _, resource := range resources {
+		for len(p.access) <= int(resource) {
+			p.access = append(p.access, None)
+		}
+		p.access[resource] |= access
+	}
+	p.trim()
+}
+
+// Intersect returns a permission which only grants what is granted by both
+// permissions.
+func (p *Permission) Intersect(other *Permission) *Permission {
+	n := p.numResources()
+	if other.numResources() > n {
+		n = other.numResources()
+	}
+
+	result := &Permission{}
+	result.SetAccess(p.get(ResourceAll)&other.get(ResourceAll), ResourceAll)
+	for resource := StripeResource(1); resource < n; resource++ {
+		effective := (p.get(resource) | p.get(ResourceAll)) & (other.get(resource) | other.get(ResourceAll))
+		result.SetAccess(effective, resource)
+	}
+	return result
+}
+
+// ParsePermission builds a permission from a comma separated list of
+// resource:access grants, e.g. "customers:read,charges:rw,refunds:create".
+func ParsePermission(grammar string) (*Permission, error) {
+	p := &Permission{}
+	if strings.TrimSpace(grammar) == "" {
+		return p, nil
+	}
+
+	for _, grant := range strings.Split(grammar, ",") {
+		parts := strings.Split(strings.TrimSpace(grant), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Grant %q must be of the form resource:access", grant)
+		}
+
+		resource, err := ParseResource(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		access, err := ParseAccess(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		p.SetAccess(access, resource)
+	}
+
+	return p, nil
+}
+
+// Grant is the access to a single resource.
+type Grant struct {
+	Resource StripeResource
+	Access   Access
+}
+
+func (g Grant) String() string {
+	return fmt.Sprintf("%s:%s", g.Resource, g.Access)
+}
+
+// Grants lists the access to each resource, in resource order.
+func (p *Permission) Grants() []Grant {
+	var grants []Grant
+	for i, access := range p.access {
+		if access != None {
+			grants = append(grants, Grant{StripeResource(i), access})
+		}
+	}
+	return grants
+}
+
+// String renders the permission in the grammar understood by ParsePermission.
+func (p *Permission) String() string {
+	var grants []string
+	for _, grant := range p.Grants() {
+		grants = append(grants, grant.String())
+	}
+	return strings.Join(grants, ",")
 }
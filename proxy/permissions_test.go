@@ -52,12 +52,12 @@ func TestPermissions(t *testing.T) {
 	assert := assert.New(t)
 
 	for _, tt := range permTests {
-		p := Permission{tt.encoded}
+		p := NewPermission(tt.encoded)
 		for _, allow := range tt.allowed {
-			assert.True(p.Can(allow.access, allow.resource), "%b permission should allow %d to %d", p.encoded, allow.access, allow.resource)
+			assert.True(p.Can(allow.access, allow.resource), "%b permission should allow %d to %d", tt.encoded, allow.access, allow.resource)
 		}
 		for _, deny := range tt.denied {
-			assert.False(p.Can(deny.access, deny.resource), "%b permission should deny %d to %d", p.encoded, deny.access, deny.resource)
+			assert.False(p.Can(deny.access, deny.resource), "%b permission should deny %d to %d", tt.encoded, deny.access, deny.resource)
 		}
 	}
 
@@ -78,11 +78,11 @@ func TestGrants(t *testing.T) {
 
 	assert := assert.New(t)
 	for _, tt := range createTests {
-		p := Permission{}
+		p := &Permission{}
 		for _, toGrant := range tt.grants {
 			p.SetAccess(toGrant.access, toGrant.resource)
 		}
-		assert.Equal(tt.expected, p.encoded)
+		assert.Equal(NewPermission(tt.expected), p)
 
 		// At the very least we should have what was granted
 		for _, toGrant := range tt.grants {
@@ -90,3 +90,147 @@ func TestGrants(t *testing.T) {
 		}
 	}
 }
+
+func TestVariableLengthPermission(t *testing.T) {
+	assert := assert.New(t)
+
+	// Resources beyond the first 32 extend the bitset
+	beyond := StripeResource(70)
+
+	p := &Permission{}
+	p.SetAccess(Read, ResourceCustomers)
+	p.SetAccess(Write, beyond)
+	assert.True(p.Can(Write, beyond))
+	assert.False(p.Can(Read, beyond))
+	assert.False(p.Can(Read, StripeResource(beyond+1)))
+	assert.True(p.Can(Read, ResourceCustomers))
+
+	encoded, err := p.MarshalBinary()
+	assert.Nil(err)
+	assert.Len(encoded, 24)
+
+	q := &Permission{}
+	assert.Nil(q.UnmarshalBinary(encoded))
+	assert.Equal(p, q)
+	assert.Equal([]Grant{{ResourceCustomers, Read}, {beyond, Write}}, q.Grants())
+
+	// Granting all covers resources beyond the first word too
+	all := NewPermission(1)
+	assert.True(all.Can(Read, beyond))
+	assert.Equal(p.Intersect(all).Grants(), []Grant{{ResourceCustomers, Read}})
+
+	// The first 32 resources keep their fixed size encoding
+	legacy := &Permission{}
+	legacy.SetAccess(Read, ResourceCustomers)
+	encoded, err = legacy.MarshalBinary()
+	assert.Nil(err)
+	assert.Equal([]byte{0, 0, 0, 0, 0, 0, 0, 64}, encoded)
+
+	// Trailing empty words don't change the permission
+	padded := append(encoded, make([]byte, 16)...)
+	assert.Nil(q.UnmarshalBinary(padded))
+	assert.Equal(legacy, q)
+
+	empty, err := (&Permission{}).MarshalBinary()
+	assert.Nil(err)
+	assert.Len(empty, 8)
+
+	for _, invalid := range [][]byte{{}, {0, 1}, make([]byte, 12)} {
+		assert.NotNil(q.UnmarshalBinary(invalid))
+	}
+}
+
+func TestPermissionGrammar(t *testing.T) {
+	var grammarTests = []struct {
+		grammar  string
+		grants   []e
+		rendered string
+	}{
+		{"", []e{}, ""},
+		{"all:read", []e{e{Read, ResourceAll}}, "all:read"},
+		{"customers:read,charges:rw,events:write",
+			[]e{e{Read, ResourceCustomers}, e{ReadWrite, ResourceCharges}, e{Write, ResourceEvents}},
+			"charges:rw,customers:read,events:write"},
+		{" radar_rules:rw , files:read",
+			[]e{e{ReadWrite, ResourceRadarRule}, e{Read, ResourceFileUploads}},
+			"files:read,radar_rules:rw"},
+		{"customers:read,customers:write", []e{e{ReadWrite, ResourceCustomers}}, "customers:rw"},
+		{"refunds:create", []e{e{Create, ResourceRefunds}}, "refunds:create"},
+		{"customers:list+retrieve+delete", []e{e{Read, ResourceCustomers}, e{Delete, ResourceCustomers}}, "customers:read+delete"},
+		{"charges:retrieve,charges:create+update,charges:delete", []e{e{ReadWrite &^ List, ResourceCharges}}, "charges:write+retrieve"},
+	}
+
+	assert := assert.New(t)
+	for _, tt := range grammarTests {
+		p, err := ParsePermission(tt.grammar)
+		assert.Nil(err)
+
+		expected := &Permission{}
+		for _, toGrant := range tt.grants {
+			expected.SetAccess(toGrant.access, toGrant.resource)
+		}
+		assert.Equal(expected, p, tt.grammar)
+		assert.Equal(tt.rendered, p.String())
+
+		// Rendering round trips
+		q, err := ParsePermission(p.String())
+		assert.Nil(err)
+		assert.Equal(p, q)
+	}
+
+	_, err := ParseAccess("read+bogus")
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), `"bogus"`)
+	}
+
+	for _, invalid := range []string{"customers", "customers:admin", "widgets:read", "customers:read:write", "customers:read,", "customers:read+", "customers:read+admin"} {
+		_, err := ParsePermission(invalid)
+		assert.NotNil(err, invalid)
+	}
+}
+
+func TestOperations(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Permission{}
+	p.SetAccess(Create, ResourceRefunds)
+	p.SetAccess(Read, ResourceCustomers)
+
+	assert.True(p.Can(Create, ResourceRefunds))
+	assert.False(p.Can(Delete, ResourceRefunds))
+	assert.False(p.Can(Write, ResourceRefunds))
+	assert.True(p.Can(List, ResourceCustomers))
+	assert.True(p.Can(Retrieve, ResourceCustomers))
+	assert.False(p.Can(Delete, ResourceCustomers))
+
+	// Individual operations can't be encoded as groups on their own
+	_, err := p.MarshalBinary()
+	assert.NotNil(err)
+	assert.Nil(p.Intersect(NewPermission(1)).marshalOperations())
+
+	// Operations granted to all resources combine with the resource's own
+	all := &Permission{}
+	all.SetAccess(List, ResourceAll)
+	all.SetAccess(Retrieve, ResourceCharges)
+	assert.True(all.Can(Read, ResourceCharges))
+	assert.False(all.Can(Read, ResourceCustomers))
+
+	// Intersections keep the operations that both grant
+	q := &Permission{}
+	q.SetAccess(Update|Create, ResourceRefunds)
+	q.SetAccess(List, ResourceAll)
+	assert.Equal([]Grant{{ResourceCustomers, List}, {ResourceRefunds, Create}}, p.Intersect(q).Grants())
+
+	for _, tt := range []struct {
+		access   Access
+		rendered string
+	}{
+		{Read, "read"},
+		{Read | Create, "read+create"},
+		{Write &^ Delete, "create+update"},
+		{ReadWrite, "rw"},
+		{Access(64), "access(64)"},
+	} {
+		assert.Equal(tt.rendered, tt.access.String())
+	}
+}
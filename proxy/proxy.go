@@ -16,64 +16,36 @@ package proxy
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/stripe/stripe-go"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ErrorResponse struct {
 	StripeError stripe.Error `json:"error"`
 }
 
-// These routes will match in order, so the ResourceAll route is a fallback and
-// transfer reversals will match before transfers.
-var resourceRoutes = []struct {
-	route string
-	sr    StripeResource
-}{
-	// Payment methods
-	{"/v1/customers/{cust_id}/sources", ResourceSource},
-
-	// Core resources
-	{"/v1/balance", ResourceBalance},
-	{"/v1/charges", ResourceCharges},
-	{"/v1/customers", ResourceCustomers},
-	{"/v1/disputes", ResourceDisputes},
-	{"/v1/events", ResourceEvents},
-	{"/v1/files", ResourceFileUploads},
-	{"/v1/refunds", ResourceRefunds},
-	{"/v1/tokens", ResourceTokens},
-	{"/v1/transfers/{transfer_id}/reversals", ResourceTransferReversals},
-	{"/v1/transfers", ResourceTransfers},
-
-	// Connect resources
-	{"/v1/accounts", ResourceAccount},
-	{"/v1/application_fees/{fee_id}/refunds", ResourceApplicationFeeRefund},
-	{"/v1/application_fees", ResourceApplicationFee},
-	{"/v1/recipients", ResourceRecipient},
-	{"/v1/country_specs", ResourceCountrySpec},
-	{"/v1/accounts/{account_id}/external_accounts", ResourceExternalAccount},
-
-	// Relay resources
-	{"/v1/orders", ResourceOrder},
-	{"/v1/order_returns", ResourceOrderReturn},
-	{"/v1/products", ResourceProduct},
-	{"/v1/skus", ResourceSKU},
-
-	// Subscription resources
-	{"/v1/coupons", ResourceCoupon},
-	{"/v1/invoices", ResourceInvoice},
-	{"/v1/invoiceitems", ResourceInvoiceItem},
-	{"/v1/plans", ResourcePlan},
-	{"/v1/subscriptions", ResourceSubscription},
-	{"/v1/subscription_items", ResourceSubscriptionItem},
-
-	// Catch all
-	{"/v1/", ResourceAll},
+// resourceRoute grants requests with the method to a path template if the
+// credential has the access to the resource. The table is generated in order
+// of specificity in resources_gen.go.
+type resourceRoute struct {
+	path     string
+	method   string
+	access   Access
+	resource StripeResource
 }
 
+// fallbackRoute requires access to all resources for paths which are not in
+// the route table.
+const fallbackRoute = "/v1/"
+
 var accessMethods = map[Access][]string{
 	Read:  []string{"GET", "HEAD"},
 	Write: []string{"POST", "DELETE", "PUT", "PATCH"},
@@ -97,10 +69,80 @@ func invalidCredentialError(msg string) *ErrorResponse {
 		}}
 }
 
-func checkPermissions(acc Access, res StripeResource, key []byte, req *http.Request) *ErrorResponse {
+func invalidRequestError(msg string) *ErrorResponse {
+	return &ErrorResponse{
+		StripeError: stripe.Error{
+			Type:           stripe.ErrorTypeInvalidRequest,
+			Msg:            msg,
+			HTTPStatusCode: 400,
+		}}
+}
+
+func internalError(msg string) *ErrorResponse {
+	return &ErrorResponse{
+		StripeError: stripe.Error{
+			Type:           stripe.ErrorTypeAPI,
+			Msg:            msg,
+			HTTPStatusCode: 500,
+		}}
+}
+
+func rateLimitError(msg string) *ErrorResponse {
+	return &ErrorResponse{
+		StripeError: stripe.Error{
+			Type:           stripe.ErrorTypeRateLimit,
+			Msg:            msg,
+			HTTPStatusCode: 429,
+		}}
+}
+
+// Option configures optional behaviour of the permissions proxy.
+type Option func(*permissionsProxy)
+
+// WithRevocations rejects credentials whose IDs are in the revocation store.
+func WithRevocations(store RevocationStore) Option {
+	return func(p *permissionsProxy) {
+		p.revocations = store
+	}
+}
+
+type permissionsProxy struct {
+	upstream    Upstream
+	upstreams   map[string]*Upstream
+	delegate    http.Handler
+	revocations RevocationStore
+
+	ledger        BudgetLedger
+	onLedgerError func(error)
+	budgetLocks   keyedLocks
+
+	limits credentialLimits
+
+	audit        AuditLog
+	onAuditError func(error)
+	metrics      *Metrics
+
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// authorization is what checkPermissions found out about an allowed request.
+type authorization struct {
+	claims    *Claims
+	params    url.Values
+	stripeKey string
+
+	// release ends the request's turn in the credential's in-flight cap.
+	release func()
+}
+
+// checkPermissions identifies the credential in the audit event as soon as it
+// is known, so that denied requests can be traced too.
+func (p *permissionsProxy) checkPermissions(rr resourceRoute, req *http.Request, event *AuditEvent) (*authorization, *ErrorResponse) {
 	authHeader := req.Header.Get("Authorization")
 	if authHeader == "" {
-		return invalidCredentialError("Request requires Authorization header")
+		p.metrics.verificationFailed(verificationMissing)
+		return nil, invalidCredentialError("Request requires Authorization header")
 
 	}
 
@@ -111,55 +153,181 @@ func checkPermissions(acc Access, res StripeResource, key []byte, req *http.Requ
 		var ok bool
 		signedPermissions, _, ok = req.BasicAuth()
 		if !ok {
-			return invalidCredentialError("Request requires valid Basic or Bearer auth header")
+			p.metrics.verificationFailed(verificationMissing)
+			return nil, invalidCredentialError("Request requires valid Basic or Bearer auth header")
 		}
 	}
 
-	granted, err := Verify(signedPermissions, key)
+	event.Fingerprint = CredentialFingerprint(signedPermissions)
+	upstream, unknown := p.upstreamFor(signedPermissions)
+	if unknown != nil {
+		return nil, unknown
+	}
+	claims, err := Verify(signedPermissions, upstream.Keys.Keyring())
 	if err != nil {
-		return invalidCredentialError(err.Error())
+		p.metrics.verificationFailed(verificationInvalid)
+		return nil, invalidCredentialError(err.Error())
 	}
+	event.CredentialID = claims.ID
+	event.Upstream = claims.Upstream
+	granted := claims.Permission
 
-	if !granted.Can(acc, res) {
-		return validButInsufficientError("Request requires permission that was not granted")
+	if p.revocations != nil && claims.ID != "" {
+		revoked, err := p.revocations.IsRevoked(claims.ID)
+		if err != nil {
+			return nil, internalError("Unable to check whether the credential has been revoked")
+		}
+		if revoked {
+			p.metrics.verificationFailed(verificationRevoked)
+			return nil, invalidCredentialError("Credential has been revoked")
+		}
+	}
+
+	stripeKey, missing := upstream.keyFor(claims.Mode)
+	if missing != nil {
+		return nil, missing
 	}
 
-	if anyExpand := req.URL.Query().Get("expand[]"); anyExpand != "" && !granted.Can(acc, ResourceAll) {
-		// This is a necessary shortcut until such time that Stripe publishes
-		// detailed machine-readable API docs, which include the mapping of
-		// expand params to response schema/resource.
-		return validButInsufficientError("Requests that expand return values must have permissions to all resources")
+	if !granted.Can(rr.access, rr.resource) {
+		return nil, validButInsufficientError("Request requires permission that was not granted")
 	}
 
-	return nil
+	// The limits are taken before anything is looked up on Stripe, so that
+	// the lookups of a limited credential count towards its limits too.
+	// Legacy credentials have no ID, so they are limited by themselves.
+	limitKey := claims.ID
+	if limitKey == "" {
+		limitKey = signedPermissions
+	}
+	release, limited := p.limits.acquire(limitKey, claims.MaxInFlight)
+	if limited != nil {
+		return nil, limited
+	}
+	if limited := p.limits.allow(limitKey, claims.RateLimit); limited != nil {
+		release()
+		return nil, limited
+	}
+
+	params, denied := p.checkRequest(claims, stripeKey, rr, req)
+	if denied != nil {
+		release()
+		return nil, denied
+	}
+	return &authorization{claims, params, stripeKey, release}, nil
 }
 
-func NewStripePermissionsProxy(stripeKey string, delegate http.Handler) http.Handler {
-	r := mux.NewRouter()
+// checkRequest checks the parameters and objects of a request which the
+// credential's permissions allow against the rest of its claims, and returns
+// the parameters.
+func (p *permissionsProxy) checkRequest(claims *Claims, stripeKey string, rr resourceRoute, req *http.Request) (url.Values, *ErrorResponse) {
+	// The account has to be settled before any object is looked up on the
+	// customer's behalf.
+	if err := checkAccountScope(claims.Accounts, req); err != nil {
+		return nil, err
+	}
 
-	stripeKeyAsBytes := []byte(stripeKey)
+	// Expanding a field embeds another object in the response, so it
+	// requires permission to retrieve that object too.
+	params, err := requestParams(req)
+	if err == errUncheckedBody && paramsRestricted(claims, rr) {
+		return nil, invalidRequestError(err.Error())
+	} else if err != nil && err != errUncheckedBody {
+		return nil, invalidRequestError(fmt.Sprintf("Unable to read the request parameters: %s", err))
+	}
+	for _, expand := range expandParams(params) {
+		for _, resource := range expandedResources(rr.resource, expand) {
+			if !claims.Permission.Can(Retrieve, resource) {
+				return nil, validButInsufficientError(fmt.Sprintf("Expanding %s requires permission to retrieve %s", expand, resource))
+			}
+		}
+	}
+
+	if err := checkSpendingLimits(claims, rr, params); err != nil {
+		return nil, err
+	}
+	if err := p.checkRefundCurrency(claims, stripeKey, rr, req, params); err != nil {
+		return nil, err
+	}
+
+	if err := p.checkCustomerScope(claims.Customers, stripeKey, rr, req, params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// NewStripePermissionsProxy checks the credentials on each request against
+// the current keyring before forwarding it to the delegate with the Stripe
+// secret key.
+func NewStripePermissionsProxy(stripeKey string, keys KeyringSource, delegate http.Handler, opts ...Option) http.Handler {
+	p := &permissionsProxy{
+		upstream: Upstream{StripeKey: stripeKey, Keys: keys},
+		delegate: delegate,
+		tracer:   noTracing,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	r := mux.NewRouter()
 
 	for _, rr := range resourceRoutes {
-		for access, methods := range accessMethods {
-			resourceToCheck := rr.sr
-			accessToCheck := access
-
-			f := func(rw http.ResponseWriter, req *http.Request) {
-				err := checkPermissions(accessToCheck, resourceToCheck, stripeKeyAsBytes, req)
-				if err != nil {
-					// Abort the request
-					rw.WriteHeader(403)
-					json.NewEncoder(rw).Encode(err)
-					return
-				}
-
-				req.SetBasicAuth(stripeKey, "")
-				delegate.ServeHTTP(rw, req)
+		r.Path(rr.path).HandlerFunc(p.handler(rr)).Methods(rr.method)
+	}
+	for access, methods := range accessMethods {
+		fallback := resourceRoute{path: fallbackRoute, access: access, resource: ResourceAll}
+		r.PathPrefix(fallbackRoute).HandlerFunc(p.handler(fallback)).Methods(methods...)
+	}
+
+	return r
+}
+
+// forward passes the request on to Stripe and returns how long it took.
+func (p *permissionsProxy) forward(rw http.ResponseWriter, req *http.Request) time.Duration {
+	start := time.Now()
+	p.delegate.ServeHTTP(rw, req)
+	return time.Since(start)
+}
+
+// handler checks the permissions for the route before forwarding the request.
+func (p *permissionsProxy) handler(rr resourceRoute) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		req, span := p.startSpan(rr, req)
+		event := &AuditEvent{
+			Time:     time.Now().UTC(),
+			Method:   req.Method,
+			Path:     req.URL.Path,
+			Resource: rr.resource.String(),
+			Decision: DecisionAllowed,
+		}
+
+		var upstream time.Duration
+		w := &statusResponseWriter{ResponseWriter: rw}
+		defer func() {
+			p.complete(event, w)
+			p.metrics.observe(rr, event, upstream)
+			endSpan(span, event)
+		}()
+		rw = w
+
+		auth, err := p.checkPermissions(rr, req, event)
+		if err == nil {
+			defer auth.release()
+
+			req.SetBasicAuth(auth.stripeKey, "")
+			if !spends(auth.claims, rr, auth.params) {
+				upstream = p.forward(rw, req)
+				return
 			}
+			upstream, err = p.forwardWithinBudget(rw, req, rr, auth)
+		}
+
+		if err != nil {
+			event.Decision = DecisionDenied
+			event.Reason = err.StripeError.Msg
 
-			r.PathPrefix(rr.route).HandlerFunc(f).Methods(methods...)
+			// Abort the request
+			rw.WriteHeader(err.StripeError.HTTPStatusCode)
+			json.NewEncoder(rw).Encode(err)
 		}
 	}
-
-	return r
 }
@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -58,10 +59,10 @@ func getBackends(s *httptest.Server) *stripe.Backends {
 	}
 }
 
-func newTeapotProxy() (http.Handler, *TeapotUpstream) {
+func newTeapotProxy(opts ...Option) (http.Handler, *TeapotUpstream) {
 	testUpstream := new(TeapotUpstream)
 	testUpstream.On("ServeHTTP").Return()
-	permProxy := NewStripePermissionsProxy(proxyTestStripeKey, testUpstream)
+	permProxy := NewStripePermissionsProxy(proxyTestStripeKey, newTestKeyring(), testUpstream, opts...)
 	return permProxy, testUpstream
 }
 
@@ -74,7 +75,7 @@ func TestPassingRequest(t *testing.T) {
 
 	p := &Permission{}
 	p.SetAccess(Read, ResourceCustomers)
-	signed, err := Sign(p, []byte(proxyTestStripeKey))
+	signed, err := Sign(&Claims{Permission: p}, newTestKeyring())
 	assert.Nil(err)
 
 	sc := &client.API{}
@@ -97,7 +98,7 @@ func TestRejectedBadCredential(t *testing.T) {
 
 	p := &Permission{}
 	p.SetAccess(Read, ResourceCustomers)
-	signed, err := Sign(p, []byte(proxyTestStripeKey))
+	signed, err := Sign(&Claims{Permission: p}, newTestKeyring())
 	assert.Nil(err)
 
 	sc := &client.API{}
@@ -113,6 +114,69 @@ func TestRejectedBadCredential(t *testing.T) {
 	assert.Equal(stripe.ErrorTypeAuthentication, stripeError.Type)
 }
 
+func TestRejectedExpiredCredential(t *testing.T) {
+	assert := assert.New(t)
+
+	proxy, testUpstream := newTeapotProxy()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	p := &Permission{}
+	p.SetAccess(Read, ResourceCustomers)
+	c := &Claims{
+		Permission: p,
+		IssuedAt:   time.Now().Add(-2 * time.Hour),
+		Expires:    time.Now().Add(-1 * time.Hour),
+	}
+	signed, err := Sign(c, newTestKeyring())
+	assert.Nil(err)
+
+	sc := &client.API{}
+	sc.Init(signed, getBackends(server))
+	custlist := sc.Customers.List(nil)
+
+	testUpstream.AssertNumberOfCalls(t, "ServeHTTP", 0)
+
+	stripeError, ok := custlist.Err().(*stripe.Error)
+	assert.True(ok)
+
+	assert.Equal(403, stripeError.HTTPStatusCode)
+	assert.Equal(stripe.ErrorTypeAuthentication, stripeError.Type)
+}
+
+func TestRejectedRevokedCredential(t *testing.T) {
+	assert := assert.New(t)
+
+	revoked := &RevocationList{}
+	proxy, testUpstream := newTeapotProxy(WithRevocations(revoked))
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	p := &Permission{}
+	p.SetAccess(Read, ResourceCustomers)
+	signed, err := Sign(&Claims{Permission: p}, newTestKeyring())
+	assert.Nil(err)
+	claims, err := Verify(signed, newTestKeyring())
+	assert.Nil(err)
+
+	sc := &client.API{}
+	sc.Init(signed, getBackends(server))
+	custlist := sc.Customers.List(nil)
+	testUpstream.AssertNumberOfCalls(t, "ServeHTTP", 1)
+
+	assert.Nil(revoked.Revoke(claims.ID, "leaked"))
+
+	custlist = sc.Customers.List(nil)
+	testUpstream.AssertNumberOfCalls(t, "ServeHTTP", 1)
+
+	stripeError, ok := custlist.Err().(*stripe.Error)
+	assert.True(ok)
+
+	assert.Equal(403, stripeError.HTTPStatusCode)
+	assert.Equal(stripe.ErrorTypeAuthentication, stripeError.Type)
+	assert.Equal("Credential has been revoked", stripeError.Msg)
+}
+
 func TestRejectedPermissions(t *testing.T) {
 	assert := assert.New(t)
 
@@ -122,7 +186,7 @@ func TestRejectedPermissions(t *testing.T) {
 
 	p := &Permission{}
 	p.SetAccess(Read, ResourceCustomers)
-	signed, err := Sign(p, []byte(proxyTestStripeKey))
+	signed, err := Sign(&Claims{Permission: p}, newTestKeyring())
 	assert.Nil(err)
 
 	sc := &client.API{}
@@ -148,7 +212,7 @@ func TestRejectedPermissions(t *testing.T) {
 
 	// Grant read on transfers now
 	p.SetAccess(Read, ResourceTransfers)
-	newGrant, err := Sign(p, []byte(proxyTestStripeKey))
+	newGrant, err := Sign(&Claims{Permission: p}, newTestKeyring())
 	assert.Nil(err)
 
 	sc.Init(newGrant, getBackends(server))
@@ -170,7 +234,7 @@ func TestExpandParams(t *testing.T) {
 
 	p := &Permission{}
 	p.SetAccess(Read, ResourceCharges)
-	signed, err := Sign(p, []byte(proxyTestStripeKey))
+	signed, err := Sign(&Claims{Permission: p}, newTestKeyring())
 	assert.Nil(err)
 
 	sc := &client.API{}
@@ -198,7 +262,7 @@ func TestExpandParams(t *testing.T) {
 
 	// By granting resource all it works again
 	p.SetAccess(Read, ResourceAll)
-	newaccess, err := Sign(p, []byte(proxyTestStripeKey))
+	newaccess, err := Sign(&Claims{Permission: p}, newTestKeyring())
 	sc.Init(newaccess, getBackends(server))
 
 	_, chWorks := sc.Charges.Get("ch_example_id", params)
@@ -207,3 +271,182 @@ func TestExpandParams(t *testing.T) {
 	assert.Equal(418, expectTeapotAgain.HTTPStatusCode)
 	testUpstream.AssertNumberOfCalls(t, "ServeHTTP", 2)
 }
+
+func TestModernResourceRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	proxy, testUpstream := newTeapotProxy()
+
+	for i, tt := range []struct {
+		method   string
+		path     string
+		access   Access
+		resource StripeResource
+	}{
+		{"GET", "/v1/payment_intents/pi_123", Read, ResourcePaymentIntent},
+		{"POST", "/v1/setup_intents", Write, ResourceSetupIntent},
+		{"GET", "/v1/payment_methods/pm_123", Read, ResourcePaymentMethod},
+		{"GET", "/v1/prices", Read, ResourcePrice},
+		{"GET", "/v1/checkout/sessions/cs_123", Read, ResourceCheckoutSession},
+		{"POST", "/v1/billing_portal/sessions", Write, ResourceBillingPortalSession},
+		{"GET", "/v1/tax_rates", Read, ResourceTaxRate},
+		{"GET", "/v1/credit_notes", Read, ResourceCreditNote},
+		{"DELETE", "/v1/webhook_endpoints/we_123", Write, ResourceWebhookEndpoint},
+		{"GET", "/v1/issuing/authorizations", Read, ResourceIssuingAuthorization},
+		{"GET", "/v1/issuing/cards/ic_123", Read, ResourceIssuingCard},
+		{"GET", "/v1/issuing/cardholders/ich_123", Read, ResourceIssuingCardholder},
+		{"GET", "/v1/issuing/disputes", Read, ResourceIssuingDispute},
+		{"GET", "/v1/issuing/transactions", Read, ResourceIssuingTransaction},
+		{"POST", "/v1/terminal/connection_tokens", Write, ResourceTerminalConnectionToken},
+		{"GET", "/v1/terminal/locations", Read, ResourceTerminalLocation},
+		{"GET", "/v1/terminal/readers", Read, ResourceTerminalReader},
+		{"GET", "/v1/reporting/report_runs", Read, ResourceReportRun},
+		{"GET", "/v1/reporting/report_types", Read, ResourceReportType},
+	} {
+		p := &Permission{}
+		p.SetAccess(tt.access, tt.resource)
+		signed, err := Sign(&Claims{Permission: p}, newTestKeyring())
+		assert.Nil(err)
+
+		assert.Equal(418, serveWithCredential(proxy, tt.method, tt.path, signed), "%s should be granted by %s", tt.path, tt.resource)
+		testUpstream.AssertNumberOfCalls(t, "ServeHTTP", i+1)
+
+		// The same access to a different resource doesn't grant the path
+		other := &Permission{}
+		other.SetAccess(tt.access, ResourceCharges)
+		signed, err = Sign(&Claims{Permission: other}, newTestKeyring())
+		assert.Nil(err)
+
+		assert.Equal(403, serveWithCredential(proxy, tt.method, tt.path, signed), "%s should not be granted by charges", tt.path)
+		testUpstream.AssertNumberOfCalls(t, "ServeHTTP", i+1)
+	}
+}
+
+func TestRouteSpecificity(t *testing.T) {
+	assert := assert.New(t)
+
+	proxy, testUpstream := newTeapotProxy()
+
+	for i, tt := range []struct {
+		method   string
+		path     string
+		access   Access
+		resource StripeResource
+	}{
+		// Nested resources match before the resource they are nested in
+		{"GET", "/v1/accounts/acct_123/external_accounts", Read, ResourceExternalAccount},
+		{"POST", "/v1/accounts/acct_123/external_accounts/ba_123", Write, ResourceExternalAccount},
+		{"GET", "/v1/transfers/tr_123/reversals", Read, ResourceTransferReversals},
+		{"POST", "/v1/charges/ch_123/refunds", Write, ResourceRefunds},
+		{"GET", "/v1/customers/cus_123/sources/src_123", Read, ResourceSource},
+
+		// Literal paths match before path variables
+		{"GET", "/v1/invoices/upcoming", Read, ResourceInvoice},
+		{"GET", "/v1/customers/search", Read, ResourceCustomers},
+
+		// Paths which are not in the specification require all resources
+		{"GET", "/v1/radar/value_lists", Read, ResourceAll},
+		{"PUT", "/v1/customers/cus_123", Write, ResourceAll},
+	} {
+		p := &Permission{}
+		p.SetAccess(tt.access, tt.resource)
+		signed, err := Sign(&Claims{Permission: p}, newTestKeyring())
+		assert.Nil(err)
+
+		assert.Equal(418, serveWithCredential(proxy, tt.method, tt.path, signed), "%s %s should be granted by %s", tt.method, tt.path, tt.resource)
+		testUpstream.AssertNumberOfCalls(t, "ServeHTTP", i+1)
+	}
+
+	// The enclosing resource no longer grants nested resources
+	p := &Permission{}
+	p.SetAccess(ReadWrite, ResourceAccount)
+	signed, err := Sign(&Claims{Permission: p}, newTestKeyring())
+	assert.Nil(err)
+	assert.Equal(403, serveWithCredential(proxy, "GET", "/v1/accounts/acct_123/external_accounts", signed))
+}
+
+func TestOperationAccess(t *testing.T) {
+	assert := assert.New(t)
+
+	proxy, testUpstream := newTeapotProxy()
+
+	p, err := ParsePermission("refunds:create,customers:read")
+	assert.Nil(err)
+	signed, err := Sign(&Claims{Permission: p}, newTestKeyring())
+	assert.Nil(err)
+
+	for i, tt := range []struct {
+		method string
+		path   string
+	}{
+		{"POST", "/v1/refunds"},
+		{"POST", "/v1/charges/ch_123/refunds"},
+		{"GET", "/v1/customers"},
+		{"GET", "/v1/customers/cus_123"},
+		{"GET", "/v1/customers/search"},
+	} {
+		assert.Equal(418, serveWithCredential(proxy, tt.method, tt.path, signed), "%s %s should be granted", tt.method, tt.path)
+		testUpstream.AssertNumberOfCalls(t, "ServeHTTP", i+1)
+	}
+
+	for _, tt := range []struct {
+		method string
+		path   string
+	}{
+		// Creating refunds doesn't allow updating or cancelling them
+		{"POST", "/v1/refunds/re_123"},
+		{"POST", "/v1/refunds/re_123/cancel"},
+		{"GET", "/v1/refunds"},
+
+		// Reading customers doesn't allow changing them
+		{"POST", "/v1/customers"},
+		{"POST", "/v1/customers/cus_123"},
+		{"DELETE", "/v1/customers/cus_123"},
+	} {
+		assert.Equal(403, serveWithCredential(proxy, tt.method, tt.path, signed), "%s %s should be denied", tt.method, tt.path)
+	}
+	testUpstream.AssertNumberOfCalls(t, "ServeHTTP", 5)
+}
+
+func TestExpandPermissions(t *testing.T) {
+	assert := assert.New(t)
+
+	proxy, testUpstream := newTeapotProxy()
+
+	p, err := ParsePermission("subscriptions:read+create,customers:retrieve,invoices:read")
+	assert.Nil(err)
+	signed, err := Sign(&Claims{Permission: p}, newTestKeyring())
+	assert.Nil(err)
+
+	serve := func(method, path, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(signed, "")
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	// Expanding readable resources is allowed in every form
+	assert.Equal(418, serve("GET", "/v1/subscriptions/sub_123?expand[]=customer", ""))
+	assert.Equal(418, serve("GET", "/v1/subscriptions?expand[0]=data.latest_invoice&expand[1]=data.customer", ""))
+	assert.Equal(418, serve("POST", "/v1/subscriptions", "customer=cus_123&expand[]=latest_invoice"))
+	testUpstream.AssertNumberOfCalls(t, "ServeHTTP", 3)
+
+	// Every resource along the path must be readable
+	assert.Equal(403, serve("GET", "/v1/subscriptions/sub_123?expand[]=latest_invoice.payment_intent", ""))
+	assert.Equal(403, serve("GET", "/v1/subscriptions?expand[0]=data.default_payment_method", ""))
+	assert.Equal(403, serve("POST", "/v1/subscriptions", "customer=cus_123&expand[0]=pending_setup_intent"))
+
+	// Fields which aren't known to map to a resource require all resources
+	assert.Equal(403, serve("GET", "/v1/subscriptions/sub_123?expand[]=schedule", ""))
+	testUpstream.AssertNumberOfCalls(t, "ServeHTTP", 3)
+}
+
+func serveWithCredential(proxy http.Handler, method, path, credentials string) int {
+	req := httptest.NewRequest(method, path, nil)
+	req.SetBasicAuth(credentials, "")
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	return rw.Code
+}
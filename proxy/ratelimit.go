@@ -0,0 +1,214 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate is a number of requests per period. The zero Rate is unlimited.
+type Rate struct {
+	Requests int64
+	Per      time.Duration
+}
+
+var rateUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+}
+
+// ParseRate parses rates such as 100/s, 600/m or 10/30s.
+func ParseRate(s string) (Rate, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return Rate{}, fmt.Errorf("Rate %q must be written as requests/period, e.g. 100/s", s)
+	}
+
+	requests, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Rate{}, fmt.Errorf("Invalid number of requests in rate %q", s)
+	}
+	per, ok := rateUnits[parts[1]]
+	if !ok {
+		per, err = time.ParseDuration(parts[1])
+		if err != nil {
+			return Rate{}, fmt.Errorf("Invalid period in rate %q", s)
+		}
+	}
+
+	r := Rate{requests, per}
+	if err := r.validate(); err != nil {
+		return Rate{}, err
+	}
+	return r, nil
+}
+
+func (r Rate) validate() error {
+	if r == (Rate{}) {
+		return nil
+	}
+	if r.Requests <= 0 {
+		return errors.New("A rate must allow at least one request")
+	}
+	if r.Per < time.Second || r.Per%time.Second != 0 {
+		return errors.New("The period of a rate must be whole seconds")
+	}
+	return nil
+}
+
+func (r Rate) String() string {
+	if r == (Rate{}) {
+		return "unlimited"
+	}
+	for unit, per := range rateUnits {
+		if r.Per == per {
+			return fmt.Sprintf("%d/%s", r.Requests, unit)
+		}
+	}
+	return fmt.Sprintf("%d/%s", r.Requests, r.Per)
+}
+
+// WithRateLimits limits every credential to the rate and number of requests in
+// flight, in addition to the limits of its claims. Zero values are unlimited.
+func WithRateLimits(rate Rate, maxInFlight int64) Option {
+	return func(p *permissionsProxy) {
+		p.limits.rate = rate
+		p.limits.maxInFlight = maxInFlight
+	}
+}
+
+// maxIdleBuckets is how many buckets are kept before the full ones, which are
+// the same as new ones, are swept.
+const maxIdleBuckets = 1024
+
+// tokenBucket holds up to Requests tokens and is refilled with Requests tokens
+// per period.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func (b *tokenBucket) refill(rate Rate, now time.Time) {
+	b.tokens += float64(rate.Requests) * float64(now.Sub(b.updated)) / float64(rate.Per)
+	if b.tokens > float64(rate.Requests) {
+		b.tokens = float64(rate.Requests)
+	}
+	b.updated = now
+}
+
+type bucketKey struct {
+	credential string
+	rate       Rate
+}
+
+// credentialLimits enforces the rates and in-flight caps of credentials. The
+// claims and the server configuration each have their own bucket.
+type credentialLimits struct {
+	rate        Rate
+	maxInFlight int64
+	now         func() time.Time
+
+	mu       sync.Mutex
+	buckets  map[bucketKey]*tokenBucket
+	inFlight map[string]int64
+}
+
+// allow takes a token from each of the buckets of the credential, or none if
+// any of them is empty.
+func (l *credentialLimits) allow(credential string, claimed Rate) *ErrorResponse {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+	if l.buckets == nil {
+		l.buckets = map[bucketKey]*tokenBucket{}
+	}
+	if len(l.buckets) > maxIdleBuckets {
+		l.sweep(now)
+	}
+
+	// Equal rates would share a bucket, so it's only taken from once
+	rates := []Rate{claimed, l.rate}
+	if claimed == l.rate {
+		rates = rates[:1]
+	}
+
+	var take []*tokenBucket
+	for _, rate := range rates {
+		if rate == (Rate{}) {
+			continue
+		}
+		key := bucketKey{credential, rate}
+		b, ok := l.buckets[key]
+		if !ok {
+			b = &tokenBucket{tokens: float64(rate.Requests), updated: now}
+			l.buckets[key] = b
+		}
+		b.refill(rate, now)
+		if b.tokens < 1 {
+			return rateLimitError(fmt.Sprintf("Credential is limited to %s requests", rate))
+		}
+		take = append(take, b)
+	}
+
+	for _, b := range take {
+		b.tokens--
+	}
+	return nil
+}
+
+func (l *credentialLimits) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		b.refill(key.rate, now)
+		if b.tokens >= float64(key.rate.Requests) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// acquire counts a request as in flight until the returned function is
+// called, unless the credential already has as many as it is allowed.
+func (l *credentialLimits) acquire(credential string, claimed int64) (func(), *ErrorResponse) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inFlight == nil {
+		l.inFlight = map[string]int64{}
+	}
+	for _, max := range []int64{claimed, l.maxInFlight} {
+		if max != 0 && l.inFlight[credential] >= max {
+			return nil, rateLimitError(fmt.Sprintf("Credential is limited to %d requests in flight", max))
+		}
+	}
+
+	l.inFlight[credential]++
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.inFlight[credential]--
+		if l.inFlight[credential] == 0 {
+			delete(l.inFlight, credential)
+		}
+	}, nil
+}
@@ -0,0 +1,213 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/stripe-go"
+)
+
+func TestParseRate(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tt := range []struct {
+		rate     string
+		expected Rate
+		rendered string
+	}{
+		{"100/s", Rate{100, time.Second}, "100/s"},
+		{"600/m", Rate{600, time.Minute}, "600/m"},
+		{"10/30s", Rate{10, 30 * time.Second}, "10/30s"},
+		{"5/1h", Rate{5, time.Hour}, "5/h"},
+	} {
+		r, err := ParseRate(tt.rate)
+		assert.Nil(err)
+		assert.Equal(tt.expected, r)
+		assert.Equal(tt.rendered, r.String())
+	}
+
+	for _, invalid := range []string{"", "100", "100/", "/s", "0/s", "-1/s", "1/500ms", "1/d", "1/s/s"} {
+		_, err := ParseRate(invalid)
+		assert.NotNil(err, invalid)
+	}
+}
+
+func TestTokenBuckets(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(1500000000, 0)
+	l := &credentialLimits{rate: Rate{3, time.Second}, now: func() time.Time { return now }}
+
+	claimed := Rate{2, time.Minute}
+	assert.Nil(l.allow("a", claimed))
+	assert.Nil(l.allow("a", claimed))
+	assert.NotNil(l.allow("a", claimed))
+
+	// Other credentials have their own buckets
+	assert.Nil(l.allow("b", Rate{}))
+	assert.Nil(l.allow("b", Rate{}))
+	assert.Nil(l.allow("b", Rate{}))
+	assert.NotNil(l.allow("b", Rate{}))
+
+	// Buckets refill over their period
+	now = now.Add(time.Second)
+	assert.Nil(l.allow("b", Rate{}))
+	assert.NotNil(l.allow("a", claimed))
+	now = now.Add(30 * time.Second)
+	assert.Nil(l.allow("a", claimed))
+	assert.NotNil(l.allow("a", claimed))
+
+	// Full buckets are forgotten once there are too many
+	for i := 0; i <= maxIdleBuckets; i++ {
+		l.allow(string(rune(i)), Rate{})
+	}
+	now = now.Add(time.Hour)
+	assert.Nil(l.allow("c", Rate{}))
+	assert.Len(l.buckets, 1)
+}
+
+func TestEqualRates(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(1500000000, 0)
+	rate := Rate{3, time.Second}
+	l := &credentialLimits{rate: rate, now: func() time.Time { return now }}
+
+	// A claimed rate equal to the server's isn't counted twice
+	for i := 0; i < 3; i++ {
+		assert.Nil(l.allow("a", rate))
+	}
+	assert.NotNil(l.allow("a", rate))
+	assert.Len(l.buckets, 1)
+}
+
+// blockingUpstream answers each request once it is released.
+type blockingUpstream struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (u *blockingUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	u.started <- struct{}{}
+	<-u.release
+}
+
+func TestRateLimitedCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	upstream := &blockingUpstream{make(chan struct{}), make(chan struct{})}
+	keys := newTestKeyring()
+	proxy := NewStripePermissionsProxy(proxyTestStripeKey, keys, upstream, WithRateLimits(Rate{}, 2))
+
+	limited, err := Sign(&Claims{Permission: NewPermission(1), RateLimit: Rate{1, time.Hour}}, keys)
+	assert.Nil(err)
+	unlimited, err := Sign(&Claims{Permission: NewPermission(1)}, keys)
+	assert.Nil(err)
+	single, err := Sign(&Claims{Permission: NewPermission(1), MaxInFlight: 1}, keys)
+	assert.Nil(err)
+
+	serve := func(credentials string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v1/charges", nil)
+		req.SetBasicAuth(credentials, "")
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	inFlight := func(credentials string) chan int {
+		done := make(chan int)
+		go func() { done <- serve(credentials).Code }()
+		<-upstream.started
+		return done
+	}
+
+	// Denied requests don't use up the rate
+	req := httptest.NewRequest("POST", "/v1/charges", nil)
+	req.SetBasicAuth(limited, "")
+	denied := httptest.NewRecorder()
+	proxy.ServeHTTP(denied, req)
+	assert.Equal(403, denied.Code)
+
+	done := inFlight(limited)
+	upstream.release <- struct{}{}
+	assert.Equal(200, <-done)
+
+	rw := serve(limited)
+	assert.Equal(429, rw.Code)
+	var body ErrorResponse
+	assert.Nil(json.Unmarshal(rw.Body.Bytes(), &body))
+	assert.Equal(stripe.ErrorTypeRateLimit, body.StripeError.Type)
+
+	// The proxy's cap applies to every credential, and the claim's on top
+	first, second := inFlight(unlimited), inFlight(unlimited)
+	assert.Equal(429, serve(unlimited).Code)
+	upstream.release <- struct{}{}
+	upstream.release <- struct{}{}
+	assert.Equal(200, <-first)
+	assert.Equal(200, <-second)
+
+	first = inFlight(single)
+	assert.Equal(429, serve(single).Code)
+	upstream.release <- struct{}{}
+	assert.Equal(200, <-first)
+
+	// Requests which are rejected don't hold on to their turn
+	first = inFlight(single)
+	upstream.release <- struct{}{}
+	assert.Equal(200, <-first)
+	first = inFlight(single)
+	upstream.release <- struct{}{}
+	assert.Equal(200, <-first)
+}
+
+func TestRateLimitedLookups(t *testing.T) {
+	assert := assert.New(t)
+
+	upstream := &objectUpstream{objects: map[string]string{
+		"/v1/charges/ch_ours":   `{"id": "ch_ours", "customer": "cus_123"}`,
+		"/v1/charges/ch_theirs": `{"id": "ch_theirs", "customer": "cus_456"}`,
+	}}
+	keys := newTestKeyring()
+	proxy := NewStripePermissionsProxy(proxyTestStripeKey, keys, upstream)
+
+	p, err := ParsePermission("charges:read")
+	assert.Nil(err)
+	signed, err := Sign(&Claims{Permission: p, Customers: []string{"cus_123"}, RateLimit: Rate{1, time.Hour}}, keys)
+	assert.Nil(err)
+
+	serve := func(path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.SetBasicAuth(signed, "")
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	// Requests denied after looking up an object use up the rate
+	assert.Equal(403, serve("/v1/charges/ch_theirs"))
+	assert.Equal([]string{"GET /v1/charges/ch_theirs"}, upstream.requests)
+
+	// Once over the rate, nothing is looked up on Stripe
+	upstream.requests = nil
+	for i := 0; i < 3; i++ {
+		assert.Equal(429, serve("/v1/charges/ch_ours"))
+	}
+	assert.Empty(upstream.requests)
+}
@@ -0,0 +1,161 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// RevocationStore is consulted for every request to reject credentials which
+// have been revoked before they expire.
+type RevocationStore interface {
+	IsRevoked(id string) (bool, error)
+}
+
+// Revocation records why and when a credential was revoked.
+type Revocation struct {
+	ID      string    `json:"id"`
+	Revoked time.Time `json:"revoked"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// RevocationList is the set of revoked credential IDs.
+type RevocationList struct {
+	Revocations []*Revocation `json:"revocations"`
+}
+
+// LoadRevocationList reads a JSON encoded revocation list from the specified
+// file. A file which does not exist yet is an empty list.
+func LoadRevocationList(path string) (*RevocationList, error) {
+	l, err := readRevocationList(path)
+	if os.IsNotExist(err) {
+		return &RevocationList{}, nil
+	}
+	return l, err
+}
+
+// readRevocationList reads a revocation list from a file which must exist.
+func readRevocationList(path string) (*RevocationList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &RevocationList{}
+	if err := json.Unmarshal(data, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Save writes the revocation list to the specified file. The file is replaced
+// atomically so that a running proxy never reads a partially written list.
+func (l *RevocationList) Save(path string) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (l *RevocationList) find(id string) int {
+	for i, r := range l.Revocations {
+		if r.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Revoke adds the credential ID to the list.
+func (l *RevocationList) Revoke(id, reason string) error {
+	if id == "" {
+		return errors.New("A credential ID must be specified")
+	}
+	if l.find(id) >= 0 {
+		return fmt.Errorf("Credential %s is already revoked", id)
+	}
+
+	l.Revocations = append(l.Revocations, &Revocation{
+		ID:      id,
+		Revoked: time.Now().UTC(),
+		Reason:  reason,
+	})
+	return nil
+}
+
+// Unrevoke removes the credential ID from the list.
+func (l *RevocationList) Unrevoke(id string) error {
+	i := l.find(id)
+	if i < 0 {
+		return fmt.Errorf("Credential %s is not revoked", id)
+	}
+
+	l.Revocations = append(l.Revocations[:i], l.Revocations[i+1:]...)
+	return nil
+}
+
+func (l *RevocationList) IsRevoked(id string) (bool, error) {
+	return l.find(id) >= 0, nil
+}
+
+// RevocationFile is a RevocationStore which reloads the revocation list when
+// the file it was loaded from changes.
+type RevocationFile struct {
+	file *watchedFile
+}
+
+// NewRevocationFile loads the revocation list from the specified file, which
+// does not need to exist yet. Once it does, removing it doesn't clear the
+// list.
+func NewRevocationFile(path string) (*RevocationFile, error) {
+	load := func(path string) (interface{}, error) {
+		return readRevocationList(path)
+	}
+
+	f := &RevocationFile{&watchedFile{path: path, load: load, missing: &RevocationList{}}}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RevocationFile) IsRevoked(id string) (bool, error) {
+	return f.file.get().(*RevocationList).IsRevoked(id)
+}
+
+// Reload reads the revocation file if it has changed since it was last
+// loaded. If the new contents are invalid or the file has been removed the
+// previous list stays in use.
+func (f *RevocationFile) Reload() error {
+	return f.file.reload()
+}
+
+// Watch checks the revocation file for changes at the specified interval
+// until the returned function is called. Errors while reloading are passed to
+// onError.
+func (f *RevocationFile) Watch(interval time.Duration, onError func(error)) func() {
+	return f.file.watch(interval, onError)
+}
@@ -0,0 +1,96 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevocationList(t *testing.T) {
+	assert := assert.New(t)
+
+	l := &RevocationList{}
+	assert.Nil(l.Revoke("abc", "leaked"))
+	assert.NotNil(l.Revoke("abc", "again"))
+	assert.NotNil(l.Revoke("", "no id"))
+
+	revoked, err := l.IsRevoked("abc")
+	assert.Nil(err)
+	assert.True(revoked)
+
+	revoked, err = l.IsRevoked("def")
+	assert.Nil(err)
+	assert.False(revoked)
+
+	assert.Nil(l.Unrevoke("abc"))
+	assert.NotNil(l.Unrevoke("abc"))
+
+	revoked, err = l.IsRevoked("abc")
+	assert.Nil(err)
+	assert.False(revoked)
+}
+
+func TestRevocationFileReload(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "revocations")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// The file doesn't need to exist until something is revoked
+	path := filepath.Join(dir, "revoked.json")
+	f, err := NewRevocationFile(path)
+	assert.Nil(err)
+
+	revoked, err := f.IsRevoked("abc")
+	assert.Nil(err)
+	assert.False(revoked)
+
+	l, err := LoadRevocationList(path)
+	assert.Nil(err)
+	assert.Nil(l.Revoke("abc", "leaked"))
+	assert.Nil(l.Save(path))
+
+	assert.Nil(f.Reload())
+	revoked, err = f.IsRevoked("abc")
+	assert.Nil(err)
+	assert.True(revoked)
+
+	// An invalid file leaves the previous list in place
+	assert.Nil(ioutil.WriteFile(path, []byte("{"), 0600))
+	assert.Nil(os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	assert.NotNil(f.Reload())
+	revoked, err = f.IsRevoked("abc")
+	assert.Nil(err)
+	assert.True(revoked)
+
+	// So does removing the file once it has existed
+	assert.Nil(os.Remove(path))
+	assert.NotNil(f.Reload())
+	revoked, err = f.IsRevoked("abc")
+	assert.Nil(err)
+	assert.True(revoked)
+
+	// A file which never existed is still fine
+	missing, err := NewRevocationFile(filepath.Join(dir, "missing.json"))
+	assert.Nil(err)
+	assert.Nil(missing.Reload())
+}
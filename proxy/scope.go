@@ -0,0 +1,282 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// customerOwnedResources are the resources whose objects belong to a
+// customer through their customer field. Customer scoped credentials can
+// only access these and the customers themselves.
+var customerOwnedResources = map[StripeResource]bool{
+	ResourceCharges:         true,
+	ResourceCheckoutSession: true,
+	ResourceCreditNote:      true,
+	ResourceInvoice:         true,
+	ResourceInvoiceItem:     true,
+	ResourcePaymentIntent:   true,
+	ResourcePaymentMethod:   true,
+	ResourceSetupIntent:     true,
+	ResourceSource:          true,
+	ResourceSubscription:    true,
+}
+
+// customerParamRoutes are the routes which filter by, or create and update
+// objects for, their customer parameter. Stripe ignores or rejects the
+// parameter elsewhere, so only these are anchored to the customer it names.
+var customerParamRoutes = map[string]bool{
+	"GET /v1/charges":                                  true,
+	"GET /v1/checkout/sessions":                        true,
+	"GET /v1/credit_notes":                             true,
+	"GET /v1/invoiceitems":                             true,
+	"GET /v1/invoices":                                 true,
+	"GET /v1/invoices/upcoming":                        true,
+	"GET /v1/invoices/upcoming/lines":                  true,
+	"GET /v1/payment_intents":                          true,
+	"GET /v1/payment_methods":                          true,
+	"GET /v1/setup_intents":                            true,
+	"GET /v1/subscriptions":                            true,
+	"POST /v1/charges":                                 true,
+	"POST /v1/charges/{charge}":                        true,
+	"POST /v1/checkout/sessions":                       true,
+	"POST /v1/invoiceitems":                            true,
+	"POST /v1/invoices":                                true,
+	"POST /v1/payment_intents":                         true,
+	"POST /v1/payment_intents/{intent}":                true,
+	"POST /v1/payment_methods/{payment_method}/attach": true,
+	"POST /v1/setup_intents":                           true,
+	"POST /v1/setup_intents/{intent}":                  true,
+	"POST /v1/subscriptions":                           true,
+}
+
+// customerVariable is the name of the path variable which holds customer IDs
+// in Stripe's path templates.
+const customerVariable = "customer"
+
+// restrictScope narrows a scope to the IDs which are also in the
+// restriction. A nil scope is unrestricted, and the result is never nil.
+func restrictScope(scope, restriction []string) []string {
+	if scope == nil {
+		return append([]string{}, restriction...)
+	}
+
+	result := []string{}
+	for _, id := range scope {
+		if inScope(restriction, id) {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+func inScope(scope []string, id string) bool {
+	for _, allowed := range scope {
+		if allowed == id {
+			return true
+		}
+	}
+	return false
+}
+
+// objectPath finds the path of the object which a request operates on, which
+// is the request path up to the first variable of the route's template, e.g.
+// /v1/charges/ch_123 for /v1/charges/{charge}/capture. Collection routes
+// have no object.
+func objectPath(template string, req *http.Request) (string, string) {
+	templateSegments := strings.Split(template, "/")
+	pathSegments := strings.Split(req.URL.Path, "/")
+	if len(templateSegments) != len(pathSegments) {
+		return "", ""
+	}
+
+	for i, segment := range templateSegments {
+		if strings.HasPrefix(segment, "{") {
+			return strings.Join(pathSegments[:i+1], "/"), strings.Trim(segment, "{}")
+		}
+	}
+	return "", ""
+}
+
+// maxLookupResponseLength bounds how much of a looked up object is buffered.
+const maxLookupResponseLength = 1 << 20
+
+// lookupResponseWriter keeps the response to a lookup, which is never sent on
+// to the client.
+type lookupResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *lookupResponseWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = http.Header{}
+	}
+	return w.header
+}
+
+func (w *lookupResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *lookupResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if remaining := maxLookupResponseLength - w.body.Len(); remaining > 0 {
+		if len(data) < remaining {
+			remaining = len(data)
+		}
+		w.body.Write(data[:remaining])
+	}
+	return len(data), nil
+}
+
+// lookupObject retrieves an object with the Stripe key, as the connected
+// account of the request if it sets one.
+func (p *permissionsProxy) lookupObject(path, stripeKey string, req *http.Request, object interface{}) error {
+	lookup, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	lookup = lookup.WithContext(req.Context())
+	if account := req.Header.Get(stripeAccountHeader); account != "" {
+		lookup.Header.Set(stripeAccountHeader, account)
+	}
+	lookup.SetBasicAuth(stripeKey, "")
+
+	rw := &lookupResponseWriter{}
+	p.delegate.ServeHTTP(rw, lookup)
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	if rw.status != http.StatusOK {
+		return fmt.Errorf("Looking up %s failed with status %d", path, rw.status)
+	}
+	return json.Unmarshal(rw.body.Bytes(), object)
+}
+
+// objectCustomer looks up the customer of an object with the Stripe key.
+func (p *permissionsProxy) objectCustomer(path, stripeKey string, req *http.Request) (string, error) {
+	var object struct {
+		Customer json.RawMessage `json:"customer"`
+	}
+	if err := p.lookupObject(path, stripeKey, req, &object); err != nil {
+		return "", err
+	}
+	if len(object.Customer) == 0 || string(object.Customer) == "null" {
+		return "", nil
+	}
+
+	// The customer may have been expanded by default
+	var id string
+	if err := json.Unmarshal(object.Customer, &id); err == nil {
+		return id, nil
+	}
+	var expanded struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(object.Customer, &expanded); err != nil {
+		return "", err
+	}
+	return expanded.ID, nil
+}
+
+// checkCustomerScope only allows requests which are anchored to one of the
+// credential's customers, through a customer in the path, the customer
+// parameter of a route in customerParamRoutes, or an object which belongs to
+// the customer. Each customer and object in the request must be in scope.
+func (p *permissionsProxy) checkCustomerScope(customers []string, stripeKey string, rr resourceRoute, req *http.Request, params url.Values) *ErrorResponse {
+	if customers == nil {
+		return nil
+	}
+
+	if rr.resource != ResourceCustomers && !customerOwnedResources[rr.resource] {
+		return validButInsufficientError(fmt.Sprintf("Customer scoped credentials can't access %s", rr.resource))
+	}
+
+	anchored := false
+	if id, ok := mux.Vars(req)[customerVariable]; ok {
+		if !inScope(customers, id) {
+			return validButInsufficientError(fmt.Sprintf("Credential does not allow access to customer %s", id))
+		}
+		anchored = true
+	}
+	for _, id := range params[customerVariable] {
+		if !inScope(customers, id) {
+			return validButInsufficientError(fmt.Sprintf("Credential does not allow access to customer %s", id))
+		}
+		anchored = anchored || customerParamRoutes[rr.method+" "+rr.path]
+	}
+
+	// Objects nested under a customer's path belong to that customer,
+	// anything else has to be looked up.
+	if path, variable := objectPath(rr.path, req); path != "" && variable != customerVariable {
+		id, err := p.objectCustomer(path, stripeKey, req)
+		if err != nil {
+			return validButInsufficientError(fmt.Sprintf("Unable to check the customer of %s", path))
+		}
+
+		// Objects without a customer, e.g. a payment method which hasn't
+		// been attached yet, may only be used with a customer in scope.
+		if id != "" && !inScope(customers, id) {
+			return validButInsufficientError(fmt.Sprintf("Credential does not allow access to objects of customer %s", id))
+		}
+		anchored = anchored || id != ""
+	}
+
+	if !anchored {
+		return validButInsufficientError("Customer scoped credentials must specify one of their customers")
+	}
+	return nil
+}
+
+// stripeAccountHeader selects the connected account which a Connect platform
+// acts as.
+const stripeAccountHeader = "Stripe-Account"
+
+// checkAccountScope only allows credentials which are bound to connected
+// accounts to act as one of them. Credentials bound to a single account act
+// as it without setting the header.
+func checkAccountScope(accounts []string, req *http.Request) *ErrorResponse {
+	if accounts == nil {
+		return nil
+	}
+
+	values := req.Header[stripeAccountHeader]
+	switch {
+	case len(values) > 1:
+		return validButInsufficientError("Request must not specify more than one Stripe-Account")
+	case len(values) == 1:
+		if !inScope(accounts, values[0]) {
+			return validButInsufficientError(fmt.Sprintf("Credential does not allow acting as account %s", values[0]))
+		}
+	case len(accounts) == 1:
+		req.Header.Set(stripeAccountHeader, accounts[0])
+	default:
+		return validButInsufficientError("Credential requires the Stripe-Account header to select one of its accounts")
+	}
+	return nil
+}
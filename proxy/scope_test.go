@@ -0,0 +1,240 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// objectUpstream answers with the objects it knows and records the requests
+// which it receives.
+type objectUpstream struct {
+	objects  map[string]string
+	requests []string
+}
+
+func (u *objectUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	u.requests = append(u.requests, req.Method+" "+req.URL.Path)
+
+	if object, ok := u.objects[req.URL.Path]; ok {
+		rw.Write([]byte(object))
+		return
+	}
+	rw.WriteHeader(404)
+}
+
+func TestCustomerScope(t *testing.T) {
+	assert := assert.New(t)
+
+	upstream := &objectUpstream{objects: map[string]string{
+		"/v1/customers/cus_123":      `{"id": "cus_123"}`,
+		"/v1/charges/ch_ours":        `{"id": "ch_ours", "customer": "cus_123"}`,
+		"/v1/charges/ch_theirs":      `{"id": "ch_theirs", "customer": "cus_456"}`,
+		"/v1/invoices/in_expanded":   `{"id": "in_expanded", "customer": {"id": "cus_123"}}`,
+		"/v1/payment_methods/pm_new": `{"id": "pm_new", "customer": null}`,
+	}}
+	proxy := NewStripePermissionsProxy(proxyTestStripeKey, newTestKeyring(), upstream)
+
+	p, err := ParsePermission("all:rw")
+	assert.Nil(err)
+	signed, err := Sign(&Claims{Permission: p, Customers: []string{"cus_123"}}, newTestKeyring())
+	assert.Nil(err)
+
+	serve := func(method, path, body string) int {
+		upstream.requests = nil
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.SetBasicAuth(signed, "")
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	// The customer itself and objects anchored to it
+	assert.Equal(200, serve("GET", "/v1/customers/cus_123", ""))
+	assert.Equal(404, serve("GET", "/v1/customers/cus_123/sources", ""))
+	assert.Equal(404, serve("GET", "/v1/charges?customer=cus_123", ""))
+	assert.Equal(404, serve("POST", "/v1/subscriptions", "customer=cus_123&items[0][price]=price_123"))
+	assert.Equal(404, serve("GET", "/v1/invoices/upcoming?customer=cus_123", ""))
+
+	// Objects are looked up before the request is forwarded
+	assert.Equal(404, serve("POST", "/v1/charges/ch_ours/capture", ""))
+	assert.Equal([]string{"GET /v1/charges/ch_ours", "POST /v1/charges/ch_ours/capture"}, upstream.requests)
+	assert.Equal(200, serve("GET", "/v1/invoices/in_expanded", ""))
+
+	// Unattached objects can only be used with a customer in scope
+	assert.Equal(404, serve("POST", "/v1/payment_methods/pm_new/attach", "customer=cus_123"))
+	assert.Equal(403, serve("POST", "/v1/payment_methods/pm_new/attach", "customer=cus_456"))
+	assert.Equal(403, serve("POST", "/v1/payment_methods/pm_new", ""))
+
+	// Bodies which aren't forms can't be checked
+	req := httptest.NewRequest("POST", "/v1/customers/cus_123", strings.NewReader(`{"description": "json"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(signed, "")
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(400, rw.Code)
+
+	for _, tt := range []struct {
+		method string
+		path   string
+		body   string
+	}{
+		// Other customers
+		{"GET", "/v1/customers/cus_456", ""},
+		{"GET", "/v1/charges?customer=cus_456", ""},
+		{"POST", "/v1/charges", "amount=100&customer=cus_123&customer=cus_456"},
+		{"GET", "/v1/charges/ch_theirs", ""},
+		{"POST", "/v1/charges/ch_theirs/capture", ""},
+		{"POST", "/v1/charges/ch_theirs", "customer=cus_123"},
+
+		// Requests which aren't anchored to a customer
+		{"GET", "/v1/customers", ""},
+		{"GET", "/v1/customers?customer=cus_123", ""},
+		{"GET", "/v1/charges/search?customer=cus_123", ""},
+		{"GET", "/v1/credit_notes/preview?customer=cus_123", ""},
+		{"GET", "/v1/customers/search", ""},
+		{"POST", "/v1/customers", ""},
+		{"GET", "/v1/charges", ""},
+
+		// Objects which can't be looked up
+		{"GET", "/v1/charges/ch_missing", ""},
+
+		// Resources which don't belong to customers
+		{"GET", "/v1/balance", ""},
+		{"GET", "/v1/products", ""},
+		{"GET", "/v1/radar/value_lists", ""},
+	} {
+		assert.Equal(403, serve(tt.method, tt.path, tt.body), "%s %s should be denied", tt.method, tt.path)
+		for _, forwarded := range upstream.requests {
+			assert.True(strings.HasPrefix(forwarded, "GET "), "%s %s should not be forwarded", tt.method, tt.path)
+		}
+	}
+}
+
+func TestAttenuatedCustomerScope(t *testing.T) {
+	assert := assert.New(t)
+
+	keys := newTestKeyring()
+	p := NewPermission(3)
+
+	scoped, err := Sign(&Claims{Permission: p, Customers: []string{"cus_123", "cus_456"}}, keys)
+	assert.Nil(err)
+
+	narrowed, err := Attenuate(scoped, &Caveat{Customers: []string{"cus_456", "cus_789"}})
+	assert.Nil(err)
+	claims, err := Verify(narrowed, keys)
+	assert.Nil(err)
+	assert.Equal([]string{"cus_456"}, claims.Customers)
+
+	// Narrowing to customers outside of the scope allows none of them
+	none, err := Attenuate(scoped, &Caveat{Customers: []string{"cus_789"}})
+	assert.Nil(err)
+	claims, err = Verify(none, keys)
+	assert.Nil(err)
+	assert.NotNil(claims.Customers)
+	assert.Empty(claims.Customers)
+
+	// Unscoped credentials are scoped by the caveat
+	unscoped, err := Sign(&Claims{Permission: p}, keys)
+	assert.Nil(err)
+	claims, err = Verify(unscoped, keys)
+	assert.Nil(err)
+	assert.Nil(claims.Customers)
+
+	scopedLater, err := Attenuate(unscoped, &Caveat{Customers: []string{"cus_789"}})
+	assert.Nil(err)
+	claims, err = Verify(scopedLater, keys)
+	assert.Nil(err)
+	assert.Equal([]string{"cus_789"}, claims.Customers)
+}
+
+// accountUpstream records the Stripe-Account header of each request.
+type accountUpstream struct {
+	accounts []string
+}
+
+func (u *accountUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	u.accounts = append(u.accounts, req.Header.Get("Stripe-Account"))
+}
+
+func TestAccountScope(t *testing.T) {
+	assert := assert.New(t)
+
+	upstream := &accountUpstream{}
+	keys := newTestKeyring()
+	proxy := NewStripePermissionsProxy(proxyTestStripeKey, keys, upstream)
+
+	serve := func(claims *Claims, accounts ...string) int {
+		signed, err := Sign(claims, keys)
+		assert.Nil(err)
+
+		upstream.accounts = nil
+		req := httptest.NewRequest("GET", "/v1/charges", nil)
+		req.SetBasicAuth(signed, "")
+		for _, account := range accounts {
+			req.Header.Add("Stripe-Account", account)
+		}
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	p := NewPermission(1)
+	single := &Claims{Permission: p, Accounts: []string{"acct_123"}}
+	several := &Claims{Permission: p, Accounts: []string{"acct_123", "acct_456"}}
+	unbound := &Claims{Permission: p}
+
+	// A single account is used without the header
+	assert.Equal(200, serve(single))
+	assert.Equal([]string{"acct_123"}, upstream.accounts)
+	assert.Equal(200, serve(single, "acct_123"))
+	assert.Equal([]string{"acct_123"}, upstream.accounts)
+
+	assert.Equal(200, serve(several, "acct_456"))
+	assert.Equal([]string{"acct_456"}, upstream.accounts)
+
+	// Unbound credentials are passed through unchanged
+	assert.Equal(200, serve(unbound))
+	assert.Equal([]string{""}, upstream.accounts)
+	assert.Equal(200, serve(unbound, "acct_789"))
+	assert.Equal([]string{"acct_789"}, upstream.accounts)
+
+	for _, denied := range []struct {
+		claims   *Claims
+		accounts []string
+	}{
+		{single, []string{"acct_789"}},
+		{single, []string{"acct_123", "acct_789"}},
+		{several, []string{"acct_789"}},
+		{several, nil},
+	} {
+		assert.Equal(403, serve(denied.claims, denied.accounts...), "%v acting as %v", denied.claims.Accounts, denied.accounts)
+		assert.Empty(upstream.accounts)
+	}
+
+	// Caveats can only narrow the accounts
+	signed, err := Sign(several, keys)
+	assert.Nil(err)
+	narrowed, err := Attenuate(signed, &Caveat{Accounts: []string{"acct_456", "acct_789"}})
+	assert.Nil(err)
+	claims, err := Verify(narrowed, keys)
+	assert.Nil(err)
+	assert.Equal([]string{"acct_456"}, claims.Accounts)
+}
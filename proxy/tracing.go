@@ -0,0 +1,90 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName identifies the proxy's spans.
+const tracerName = "github.com/coreos/stripe-proxy/proxy"
+
+// WithTracing records a span for every request, which continues the trace of
+// the request's propagated context. The delegate is called with the span's
+// context, so that calls to Stripe can be traced as its children.
+func WithTracing(provider trace.TracerProvider, propagator propagation.TextMapPropagator) Option {
+	return func(p *permissionsProxy) {
+		p.tracer = provider.Tracer(tracerName)
+		p.propagator = propagator
+	}
+}
+
+// noTracing is used unless WithTracing is given.
+var noTracing = noop.NewTracerProvider().Tracer(tracerName)
+
+// traceHeaders carry the caller's trace context, which is never sent on to
+// Stripe.
+var traceHeaders = []string{"traceparent", "tracestate", "baggage"}
+
+// startSpan starts the server span of a request. Its name is the route's
+// template rather than the path, which would name every object. The trace
+// context is removed from the request once it has been extracted.
+func (p *permissionsProxy) startSpan(rr resourceRoute, req *http.Request) (*http.Request, trace.Span) {
+	ctx := req.Context()
+	headers := traceHeaders
+	if p.propagator != nil {
+		ctx = p.propagator.Extract(ctx, propagation.HeaderCarrier(req.Header))
+		headers = append(p.propagator.Fields(), headers...)
+	}
+	for _, header := range headers {
+		req.Header.Del(header)
+	}
+
+	ctx, span := p.tracer.Start(ctx, req.Method+" "+rr.path,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("http.route", rr.path),
+			attribute.String("url.path", req.URL.Path),
+			attribute.String("stripe_proxy.resource", rr.resource.String()),
+			attribute.String("stripe_proxy.access", rr.access.String()),
+		))
+	return req.WithContext(ctx), span
+}
+
+// endSpan records the outcome of the request, which is an error only if the
+// proxy or Stripe failed.
+func endSpan(span trace.Span, event *AuditEvent) {
+	span.SetAttributes(
+		attribute.String("stripe_proxy.decision", event.Decision),
+		attribute.Int("http.response.status_code", event.Status),
+	)
+	if event.Reason != "" {
+		span.SetAttributes(attribute.String("stripe_proxy.reason", event.Reason))
+	}
+	if event.RequestID != "" {
+		span.SetAttributes(attribute.String("stripe.request_id", event.RequestID))
+	}
+	if event.Status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(event.Status))
+	}
+	span.End()
+}
@@ -0,0 +1,124 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedUpstream records a client span for each call, like an instrumented
+// transport would.
+type tracedUpstream struct {
+	tracer  trace.Tracer
+	status  int
+	headers http.Header
+}
+
+func (u *tracedUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	u.headers = req.Header
+	_, span := u.tracer.Start(req.Context(), "Stripe "+req.Method, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	rw.Header().Set(stripeRequestIDHeader, "req_123")
+	rw.WriteHeader(u.status)
+}
+
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+	return attributes
+}
+
+func TestTracing(t *testing.T) {
+	assert := assert.New(t)
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	upstream := &tracedUpstream{tracer: provider.Tracer("upstream"), status: 200}
+	keys := newTestKeyring()
+	proxy := NewStripePermissionsProxy(proxyTestStripeKey, keys, upstream, WithTracing(provider, propagation.TraceContext{}))
+
+	claims := &Claims{ID: "traced", Permission: &Permission{}}
+	claims.Permission.SetAccess(Read, ResourceCharges)
+	signed, err := Sign(claims, keys)
+	assert.Nil(err)
+
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	serve := func(method, path string) {
+		req := httptest.NewRequest(method, path, nil)
+		req.SetBasicAuth(signed, "")
+		req.Header.Set("traceparent", parent)
+		req.Header.Set("tracestate", "vendor=value")
+		req.Header.Set("baggage", "user=123")
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// The incoming trace is continued, and Stripe is called within it
+	serve("GET", "/v1/charges/ch_123")
+	spans := recorder.Ended()
+	if !assert.Len(spans, 2) {
+		return
+	}
+	client, server := spans[0], spans[1]
+	assert.Equal("GET /v1/charges/{charge}", server.Name())
+	assert.Equal(trace.SpanKindServer, server.SpanKind())
+	assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext().TraceID().String())
+	assert.Equal("00f067aa0ba902b7", server.Parent().SpanID().String())
+	assert.Equal(server.SpanContext().SpanID(), client.Parent().SpanID())
+
+	// The trace context is never sent on to Stripe
+	for _, header := range []string{"traceparent", "tracestate", "baggage"} {
+		assert.Empty(upstream.headers.Get(header), header)
+	}
+
+	attributes := spanAttributes(server)
+	assert.Equal("charges", attributes["stripe_proxy.resource"].AsString())
+	assert.Equal("retrieve", attributes["stripe_proxy.access"].AsString())
+	assert.Equal(DecisionAllowed, attributes["stripe_proxy.decision"].AsString())
+	assert.Equal(int64(200), attributes["http.response.status_code"].AsInt64())
+	assert.Equal("req_123", attributes["stripe.request_id"].AsString())
+	assert.Equal(codes.Unset, server.Status().Code)
+
+	// Denied requests never reach Stripe
+	serve("POST", "/v1/charges")
+	spans = recorder.Ended()
+	if !assert.Len(spans, 3) {
+		return
+	}
+	attributes = spanAttributes(spans[2])
+	assert.Equal(DecisionDenied, attributes["stripe_proxy.decision"].AsString())
+	assert.Equal("Request requires permission that was not granted", attributes["stripe_proxy.reason"].AsString())
+	assert.Equal(codes.Unset, spans[2].Status().Code)
+
+	// Failures upstream are errors
+	upstream.status = 502
+	serve("GET", "/v1/charges")
+	spans = recorder.Ended()
+	if !assert.Len(spans, 5) {
+		return
+	}
+	assert.Equal(codes.Error, spans[4].Status().Code)
+}
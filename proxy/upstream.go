@@ -0,0 +1,148 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+)
+
+// Upstream is a Stripe account which the proxy forwards requests to, with the
+// keyring that verifies the credentials which target it.
+type Upstream struct {
+	// StripeKey is used for credentials without a mode, and TestKey and
+	// LiveKey for credentials of each mode, see keyFor.
+	StripeKey string
+	TestKey   string
+	LiveKey   string
+
+	Keys KeyringSource
+}
+
+// keyFor finds the Stripe key for credentials of the mode. A credential of
+// one mode is never given a key of the other.
+func (u *Upstream) keyFor(mode Mode) (string, *ErrorResponse) {
+	if mode == ModeDefault {
+		if u.StripeKey == "" {
+			return "", internalError("Proxy has no default Stripe key for credentials without a mode")
+		}
+		return u.StripeKey, nil
+	}
+
+	key := u.TestKey
+	if mode == ModeLive {
+		key = u.LiveKey
+	}
+	if key == "" {
+		key = u.StripeKey
+	}
+	if KeyMode(key) != mode {
+		return "", internalError(fmt.Sprintf("Proxy has no Stripe key for %s mode credentials", mode))
+	}
+	return key, nil
+}
+
+// WithUpstreams adds named Stripe accounts, which credentials select with
+// their Upstream claim. Credentials without one use the Stripe key and
+// keyring which the proxy was created with.
+func WithUpstreams(upstreams map[string]*Upstream) Option {
+	return func(p *permissionsProxy) {
+		p.upstreams = upstreams
+	}
+}
+
+// upstreamFor finds the upstream which a credential targets. The claims are
+// read without verifying them, which is safe since the credential is then
+// verified with the upstream's own keyring.
+func (p *permissionsProxy) upstreamFor(credentials string) (*Upstream, *ErrorResponse) {
+	claims, err := Decode(credentials)
+	if err != nil {
+		p.metrics.verificationFailed(verificationInvalid)
+		return nil, invalidCredentialError(err.Error())
+	}
+	if claims.Upstream == "" {
+		return &p.upstream, nil
+	}
+
+	upstream, ok := p.upstreams[claims.Upstream]
+	if !ok {
+		p.metrics.verificationFailed(verificationUnknownUpstream)
+		return nil, invalidCredentialError(fmt.Sprintf("Credential targets the unknown Stripe account %s", claims.Upstream))
+	}
+	return upstream, nil
+}
+
+var upstreamNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// UpstreamConfig is the JSON file which names the Stripe accounts that the
+// proxy serves.
+type UpstreamConfig struct {
+	Upstreams []*UpstreamEntry `json:"upstreams"`
+}
+
+// UpstreamEntry configures a named Stripe account. The keyring path is
+// relative to the configuration file.
+type UpstreamEntry struct {
+	Name          string `json:"name"`
+	StripeKey     string `json:"stripe_key,omitempty"`
+	TestStripeKey string `json:"test_stripe_key,omitempty"`
+	LiveStripeKey string `json:"live_stripe_key,omitempty"`
+	Keyring       string `json:"keyring"`
+}
+
+// LoadUpstreamConfig reads and validates the upstream configuration, and
+// resolves the keyring paths.
+func LoadUpstreamConfig(path string) (*UpstreamConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &UpstreamConfig{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %s", path, err)
+	}
+
+	names := map[string]bool{}
+	for _, entry := range c.Upstreams {
+		if !upstreamNamePattern.MatchString(entry.Name) {
+			return nil, fmt.Errorf("Upstream name %q must be lowercase letters, digits, - and _", entry.Name)
+		}
+		if names[entry.Name] {
+			return nil, fmt.Errorf("Upstream %s is configured twice", entry.Name)
+		}
+		names[entry.Name] = true
+
+		if entry.StripeKey == "" && entry.TestStripeKey == "" && entry.LiveStripeKey == "" {
+			return nil, fmt.Errorf("Upstream %s must have a Stripe key", entry.Name)
+		}
+		if entry.TestStripeKey != "" && KeyMode(entry.TestStripeKey) != ModeTest {
+			return nil, fmt.Errorf("The test_stripe_key of upstream %s must be a test mode key", entry.Name)
+		}
+		if entry.LiveStripeKey != "" && KeyMode(entry.LiveStripeKey) != ModeLive {
+			return nil, fmt.Errorf("The live_stripe_key of upstream %s must be a live mode key", entry.Name)
+		}
+		if entry.Keyring == "" {
+			return nil, fmt.Errorf("Upstream %s must have a keyring", entry.Name)
+		}
+		if !filepath.IsAbs(entry.Keyring) {
+			entry.Keyring = filepath.Join(filepath.Dir(path), entry.Keyring)
+		}
+	}
+	return c, nil
+}
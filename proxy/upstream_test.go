@@ -0,0 +1,174 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newUpstreamKeyring(t *testing.T) *Keyring {
+	key, err := NewSigningKey(AlgorithmHMACSHA256)
+	assert.Nil(t, err)
+	return &Keyring{Keys: []*SigningKey{key}}
+}
+
+func TestUpstreams(t *testing.T) {
+	assert := assert.New(t)
+
+	defaultKeys := newTestKeyring()
+	euKeys, usKeys := newUpstreamKeyring(t), newUpstreamKeyring(t)
+
+	upstream := &keyUpstream{}
+	proxy := NewStripePermissionsProxy("sk_live_default", defaultKeys, upstream, WithUpstreams(map[string]*Upstream{
+		"eu": {StripeKey: "sk_live_eu", TestKey: "sk_test_eu", Keys: euKeys},
+		"us": {StripeKey: "sk_live_us", Keys: usKeys},
+	}))
+
+	sign := func(claims *Claims, keys *Keyring) string {
+		claims.Permission = NewPermission(1)
+		signed, err := Sign(claims, keys)
+		assert.Nil(err)
+		return signed
+	}
+
+	for _, tt := range []struct {
+		credentials string
+		status      int
+		key         string
+	}{
+		{sign(&Claims{}, defaultKeys), 200, "sk_live_default"},
+		{sign(&Claims{Upstream: "eu"}, euKeys), 200, "sk_live_eu"},
+		{sign(&Claims{Upstream: "eu", Mode: ModeTest}, euKeys), 200, "sk_test_eu"},
+		{sign(&Claims{Upstream: "us"}, usKeys), 200, "sk_live_us"},
+
+		// Each upstream only accepts credentials signed by its own keyring
+		{sign(&Claims{Upstream: "eu"}, usKeys), 403, ""},
+		{sign(&Claims{Upstream: "eu"}, defaultKeys), 403, ""},
+		{sign(&Claims{}, euKeys), 403, ""},
+		{sign(&Claims{Upstream: "apac"}, defaultKeys), 403, ""},
+
+		// The upstream's keys don't fall back to the default ones
+		{sign(&Claims{Upstream: "us", Mode: ModeTest}, usKeys), 500, ""},
+	} {
+		upstream.keys = nil
+		req := httptest.NewRequest("GET", "/v1/charges", nil)
+		req.SetBasicAuth(tt.credentials, "")
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+
+		assert.Equal(tt.status, rw.Code)
+		if tt.key != "" {
+			assert.Equal([]string{tt.key}, upstream.keys)
+		} else {
+			assert.Empty(upstream.keys)
+		}
+	}
+}
+
+// retarget points signed credentials at another upstream without signing
+// them again.
+func retarget(t *testing.T, credentials, upstream string) string {
+	parts := strings.Split(credentials, separator)
+	claims := &Claims{}
+	claimsBytes, err := base64.RawStdEncoding.DecodeString(parts[0])
+	assert.Nil(t, err)
+	assert.Nil(t, claims.UnmarshalBinary(claimsBytes))
+	claims.Upstream = upstream
+	claimsBytes, err = claims.MarshalBinary()
+	assert.Nil(t, err)
+	parts[0] = base64.RawStdEncoding.EncodeToString(claimsBytes)
+	return strings.Join(parts, separator)
+}
+
+func TestRetargetedCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	euKeys, sharedKeys := newUpstreamKeyring(t), newUpstreamKeyring(t)
+	upstream := &keyUpstream{}
+	proxy := NewStripePermissionsProxy("sk_live_default", newTestKeyring(), upstream, WithUpstreams(map[string]*Upstream{
+		"eu":      {StripeKey: "sk_live_eu", Keys: euKeys},
+		"us":      {StripeKey: "sk_live_us", Keys: sharedKeys},
+		"us-east": {StripeKey: "sk_live_us_east", Keys: sharedKeys},
+	}))
+
+	serve := func(credentials string) int {
+		upstream.keys = nil
+		req := httptest.NewRequest("GET", "/v1/charges", nil)
+		req.SetBasicAuth(credentials, "")
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	eu, err := Sign(&Claims{Permission: NewPermission(1), Upstream: "eu"}, euKeys)
+	assert.Nil(err)
+	us, err := Sign(&Claims{Permission: NewPermission(1), Upstream: "us"}, sharedKeys)
+	assert.Nil(err)
+	assert.Equal(200, serve(eu))
+	assert.Equal(200, serve(us))
+
+	// The upstream is part of the signed claims, so editing it breaks the
+	// signature even when the other upstream has the same keyring
+	for _, credentials := range []string{retarget(t, eu, "us"), retarget(t, us, "us-east"), retarget(t, us, "")} {
+		assert.Equal(403, serve(credentials))
+		assert.Empty(upstream.keys)
+	}
+}
+
+func TestLoadUpstreamConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "upstreams")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "upstreams.json")
+	write := func(config string) {
+		assert.Nil(ioutil.WriteFile(path, []byte(config), 0600))
+	}
+
+	write(`{"upstreams": [
+		{"name": "eu", "live_stripe_key": "sk_live_eu", "test_stripe_key": "sk_test_eu", "keyring": "eu.json"},
+		{"name": "us-east", "stripe_key": "sk_live_us", "keyring": "/etc/stripe-proxy/us.json"}
+	]}`)
+	c, err := LoadUpstreamConfig(path)
+	assert.Nil(err)
+	assert.Len(c.Upstreams, 2)
+	assert.Equal(filepath.Join(dir, "eu.json"), c.Upstreams[0].Keyring)
+	assert.Equal("/etc/stripe-proxy/us.json", c.Upstreams[1].Keyring)
+
+	for _, invalid := range []string{
+		`{"upstreams": [{"name": "EU", "stripe_key": "sk_live_eu", "keyring": "eu.json"}]}`,
+		`{"upstreams": [{"name": "", "stripe_key": "sk_live_eu", "keyring": "eu.json"}]}`,
+		`{"upstreams": [{"name": "eu", "keyring": "eu.json"}]}`,
+		`{"upstreams": [{"name": "eu", "stripe_key": "sk_live_eu"}]}`,
+		`{"upstreams": [{"name": "eu", "test_stripe_key": "sk_live_eu", "keyring": "eu.json"}]}`,
+		`{"upstreams": [{"name": "eu", "live_stripe_key": "sk_test_eu", "keyring": "eu.json"}]}`,
+		`{"upstreams": [{"name": "eu", "stripe_key": "sk_live_eu", "keyring": "eu.json"}, {"name": "eu", "stripe_key": "sk_live_eu", "keyring": "eu.json"}]}`,
+		`{"upstreams": `,
+	} {
+		write(invalid)
+		_, err := LoadUpstreamConfig(path)
+		assert.NotNil(err, invalid)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright © 2017 stripe-proxy authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// watchedFile holds a value which was loaded from a file, and loads it again
+// when the modification time of the file changes. If the file can't be loaded
+// the previous value stays in use.
+type watchedFile struct {
+	path string
+	load func(path string) (interface{}, error)
+
+	// missing is the value of an optional file until it first exists, files
+	// without one are required. Once an optional file has existed, it
+	// disappearing is an error like any other.
+	missing interface{}
+
+	mu      sync.RWMutex
+	value   interface{}
+	modTime time.Time
+	loaded  bool
+}
+
+func (f *watchedFile) get() interface{} {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.value
+}
+
+func (f *watchedFile) reload() error {
+	f.mu.RLock()
+	loaded, existed, previous := f.loaded, !f.modTime.IsZero(), f.modTime
+	f.mu.RUnlock()
+
+	info, err := os.Stat(f.path)
+	if os.IsNotExist(err) && f.missing != nil && !existed {
+		if !loaded {
+			f.mu.Lock()
+			f.value, f.loaded = f.missing, true
+			f.mu.Unlock()
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	modTime := info.ModTime()
+	if loaded && modTime.Equal(previous) {
+		return nil
+	}
+
+	value, err := f.load(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.value = value
+	f.modTime = modTime
+	f.loaded = true
+	return nil
+}
+
+func (f *watchedFile) watch(interval time.Duration, onError func(error)) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if err := f.reload(); err != nil {
+					onError(err)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}